@@ -0,0 +1,85 @@
+package main
+
+import "image"
+
+// bleedColor fills the colour of fully transparent pixels in m from their
+// neighbours, in place, so that bilinear filtering and mipmapping do not pull
+// arbitrary colour into visible edges. Each of up to iterations passes gives
+// every transparent pixel next to a visible or already filled pixel the
+// average colour of those neighbours, growing the filled area by one pixel.
+// Alpha is left untouched. It returns how many pixels were filled.
+func bleedColor(m *image.NRGBA, iterations int) int {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	filled := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		row := m.Pix[m.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			filled[y*w+x] = row[x*4+3] != 0
+		}
+	}
+
+	// The frontier holds the transparent pixels next to filled ones; each
+	// pass only looks at those, so the work does not grow with iterations.
+	queued := make([]bool, w*h)
+	var frontier []int
+	enqueueNeighbours := func(i int) {
+		x, y := i%w, i/w
+		for ny := y - 1; ny <= y+1; ny++ {
+			for nx := x - 1; nx <= x+1; nx++ {
+				if nx < 0 || ny < 0 || nx >= w || ny >= h {
+					continue
+				}
+				if j := ny*w + nx; !filled[j] && !queued[j] {
+					queued[j] = true
+					frontier = append(frontier, j)
+				}
+			}
+		}
+	}
+	for i, f := range filled {
+		if f {
+			enqueueNeighbours(i)
+		}
+	}
+
+	type fill struct {
+		i       int
+		r, g, b uint8
+	}
+	var fills []fill
+	total := 0
+	for pass := 0; pass < iterations && len(frontier) > 0; pass++ {
+		fills = fills[:0]
+		for _, i := range frontier {
+			x, y := i%w, i/w
+			var r, g, bl, n int
+			for ny := y - 1; ny <= y+1; ny++ {
+				for nx := x - 1; nx <= x+1; nx++ {
+					if nx < 0 || ny < 0 || nx >= w || ny >= h || !filled[ny*w+nx] {
+						continue
+					}
+					p := m.Pix[m.PixOffset(b.Min.X+nx, b.Min.Y+ny):]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					n++
+				}
+			}
+			fills = append(fills, fill{i, uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((bl + n/2) / n)})
+		}
+		// Apply the pass only once it is complete, so that pixels filled in
+		// it do not feed each other.
+		frontier = frontier[:0]
+		for _, f := range fills {
+			p := m.Pix[m.PixOffset(b.Min.X+f.i%w, b.Min.Y+f.i/w):]
+			p[0], p[1], p[2] = f.r, f.g, f.b
+			filled[f.i] = true
+		}
+		for _, f := range fills {
+			enqueueNeighbours(f.i)
+		}
+		total += len(fills)
+	}
+	return total
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBleedColor(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 1}
+	hidden := color.NRGBA{B: 255}
+	row := func(pixels ...color.NRGBA) *image.NRGBA {
+		m := image.NewNRGBA(image.Rect(0, 0, len(pixels), 1))
+		for x, c := range pixels {
+			m.SetNRGBA(x, 0, c)
+		}
+		return m
+	}
+
+	cases := []struct {
+		name       string
+		src        *image.NRGBA
+		iterations int
+		filled     int
+		// want lists the colour of each pixel, alpha aside.
+		want []color.NRGBA
+	}{
+		{
+			name:       "no iterations",
+			src:        row(red, hidden, hidden),
+			iterations: 0,
+			filled:     0,
+			want:       []color.NRGBA{red, hidden, hidden},
+		},
+		{
+			name:       "growth stops after the iterations",
+			src:        row(red, hidden, hidden, hidden, hidden),
+			iterations: 2,
+			filled:     2,
+			want:       []color.NRGBA{red, red, red, hidden, hidden},
+		},
+		{
+			name:       "nearest visible neighbour",
+			src:        row(red, hidden, hidden, hidden, green),
+			iterations: 1,
+			filled:     2,
+			want:       []color.NRGBA{red, red, hidden, green, green},
+		},
+		{
+			name:       "pixels reached from both sides average",
+			src:        row(red, hidden, hidden, hidden, green),
+			iterations: 5,
+			filled:     3,
+			want:       []color.NRGBA{red, red, {R: 128, G: 128}, green, green},
+		},
+		{
+			name:       "nothing visible",
+			src:        row(hidden, hidden),
+			iterations: 5,
+			filled:     0,
+			want:       []color.NRGBA{hidden, hidden},
+		},
+	}
+	for _, c := range cases {
+		var alpha []byte
+		for i := 3; i < len(c.src.Pix); i += 4 {
+			alpha = append(alpha, c.src.Pix[i])
+		}
+
+		if n := bleedColor(c.src, c.iterations); n != c.filled {
+			t.Errorf("%s: filled %d pixels, want %d", c.name, n, c.filled)
+		}
+		for x, want := range c.want {
+			got := c.src.NRGBAAt(x, 0)
+			if got.R != want.R || got.G != want.G || got.B != want.B {
+				t.Errorf("%s: pixel %d is %v, want the colour of %v", c.name, x, got, want)
+			}
+		}
+		var after []byte
+		for i := 3; i < len(c.src.Pix); i += 4 {
+			after = append(after, c.src.Pix[i])
+		}
+		if !bytes.Equal(after, alpha) {
+			t.Errorf("%s: alpha changed from %v to %v", c.name, alpha, after)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// xy is a CIE 1931 chromaticity.
+type xy struct{ x, y float64 }
+
+// vec3 is a CIE XYZ colour or a linear RGB triple.
+type vec3 [3]float64
+
+// mat3 is a 3x3 matrix applied to column vectors.
+type mat3 [3][3]float64
+
+var identity3 = mat3{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+
+var (
+	whiteD65 = xy{0.3127, 0.3290}
+	// iccD50 is the ICC profile connection space illuminant.
+	iccD50 = vec3{0.9642, 1.0, 0.8249}
+
+	srgbPrimaries = [3]xy{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}}
+
+	bradford = mat3{
+		{0.8951, 0.2664, -0.1614},
+		{-0.7502, 1.7135, 0.0367},
+		{0.0389, -0.0685, 1.0296},
+	}
+)
+
+func (c xy) xyz() vec3 {
+	return vec3{c.x / c.y, 1, (1 - c.x - c.y) / c.y}
+}
+
+func (m mat3) mul(n mat3) mat3 {
+	var r mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				r[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return r
+}
+
+func (m mat3) apply(v vec3) vec3 {
+	var r vec3
+	for i := 0; i < 3; i++ {
+		r[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+	return r
+}
+
+// inverse returns the inverse of m, or false if m is singular.
+func (m mat3) inverse() (mat3, bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-12 {
+		return mat3{}, false
+	}
+	var r mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i], for the transposed adjugate.
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			r[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return r, true
+}
+
+func (m mat3) near(n mat3, tolerance float64) bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if math.Abs(m[i][j]-n[i][j]) > tolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rgbToXYZ returns the matrix taking linear RGB with the given primaries and
+// white point to XYZ.
+func rgbToXYZ(primaries [3]xy, white xy) (mat3, bool) {
+	var p mat3
+	for i, c := range primaries {
+		v := c.xyz()
+		for k := 0; k < 3; k++ {
+			p[k][i] = v[k]
+		}
+	}
+	inv, ok := p.inverse()
+	if !ok {
+		return mat3{}, false
+	}
+	s := inv.apply(white.xyz())
+	for k := 0; k < 3; k++ {
+		for i := 0; i < 3; i++ {
+			p[k][i] *= s[i]
+		}
+	}
+	return p, true
+}
+
+// adapt returns the Bradford chromatic adaptation from white point src to
+// dst, both given as XYZ.
+func adapt(src, dst vec3) mat3 {
+	s := bradford.apply(src)
+	d := bradford.apply(dst)
+	scale := mat3{{d[0] / s[0], 0, 0}, {0, d[1] / s[1], 0}, {0, 0, d[2] / s[2]}}
+	inv, _ := bradford.inverse()
+	return inv.mul(scale).mul(bradford)
+}
+
+// xyzToSRGB takes D65 XYZ to linear sRGB.
+var xyzToSRGB = func() mat3 {
+	m, _ := rgbToXYZ(srgbPrimaries, whiteD65)
+	inv, _ := m.inverse()
+	return inv
+}()
+
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 || v != v {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// colorTransform converts pixel data from a source colour space to sRGB:
+// each channel is linearised with its transfer function, the primaries are
+// mapped with matrix and the result is sRGB-encoded. Alpha is untouched.
+type colorTransform struct {
+	// source describes the source colour space in reports.
+	source string
+	// decode linearises the red, green and blue channels, or the gray
+	// channel through decode[0] for grayscale images.
+	decode [3]func(float64) float64
+	// matrix maps linear source RGB to linear sRGB.
+	matrix mat3
+}
+
+// encodeTableBits sets the size of the table used to sRGB-encode linear
+// values.
+const encodeTableBits = 16
+
+// transformer holds the lookup tables a colorTransform is applied through.
+type transformer struct {
+	t        *colorTransform
+	identity bool
+	encode   []uint16
+}
+
+func newTransformer(t *colorTransform) *transformer {
+	n := 1 << encodeTableBits
+	tr := &transformer{t: t, identity: t.matrix.near(identity3, 1e-9), encode: make([]uint16, n)}
+	for i := range tr.encode {
+		tr.encode[i] = uint16(math.Round(srgbEncode(float64(i)/float64(n-1)) * 0xffff))
+	}
+	return tr
+}
+
+func (tr *transformer) encode16(linear float64) uint16 {
+	return tr.encode[int(clamp01(linear)*float64(len(tr.encode)-1)+0.5)]
+}
+
+// decodeTables tabulates the transfer functions for input values in
+// [0, max].
+func (tr *transformer) decodeTables(max int) [3][]float64 {
+	var tables [3][]float64
+	for c := 0; c < 3; c++ {
+		tables[c] = make([]float64, max+1)
+		for i := range tables[c] {
+			tables[c][i] = tr.t.decode[c](float64(i) / float64(max))
+		}
+	}
+	return tables
+}
+
+// rgb converts one pixel of channel values already linearised by tables.
+func (tr *transformer) rgb(r, g, b float64) (uint16, uint16, uint16) {
+	if !tr.identity {
+		v := tr.t.matrix.apply(vec3{r, g, b})
+		r, g, b = v[0], v[1], v[2]
+	}
+	return tr.encode16(r), tr.encode16(g), tr.encode16(b)
+}
+
+func to8(v uint16) uint8 { return uint8((uint32(v)*255 + 32767) / 65535) }
+
+// applyColorTransform converts img to sRGB with t, in place where img's
+// format allows it, and returns the converted image.
+func applyColorTransform(img image.Image, t *colorTransform) image.Image {
+	tr := newTransformer(t)
+	switch src := img.(type) {
+	case *image.Paletted:
+		tables := tr.decodeTables(255)
+		palette := make(color.Palette, len(src.Palette))
+		for i, pc := range src.Palette {
+			c := color.NRGBAModel.Convert(pc).(color.NRGBA)
+			r, g, b := tr.rgb(tables[0][c.R], tables[1][c.G], tables[2][c.B])
+			palette[i] = color.NRGBA{R: to8(r), G: to8(g), B: to8(b), A: c.A}
+		}
+		src.Palette = palette
+		return src
+	case *image.Gray:
+		table := tr.decodeTables(255)[0]
+		var lut [256]uint8
+		for i := range lut {
+			lut[i] = to8(tr.encode16(table[i]))
+		}
+		for i, v := range src.Pix {
+			src.Pix[i] = lut[v]
+		}
+		return src
+	case *image.Gray16:
+		table := tr.decodeTables(0xffff)[0]
+		for i := 0; i+1 < len(src.Pix); i += 2 {
+			v := tr.encode16(table[uint16(src.Pix[i])<<8|uint16(src.Pix[i+1])])
+			src.Pix[i], src.Pix[i+1] = uint8(v>>8), uint8(v)
+		}
+		return src
+	case *image.NRGBA64:
+		tables := tr.decodeTables(0xffff)
+		for i := 0; i+7 < len(src.Pix); i += 8 {
+			p := src.Pix[i : i+8]
+			r, g, b := tr.rgb(
+				tables[0][uint16(p[0])<<8|uint16(p[1])],
+				tables[1][uint16(p[2])<<8|uint16(p[3])],
+				tables[2][uint16(p[4])<<8|uint16(p[5])])
+			p[0], p[1], p[2], p[3], p[4], p[5] = uint8(r>>8), uint8(r), uint8(g>>8), uint8(g), uint8(b>>8), uint8(b)
+		}
+		return src
+	case *image.RGBA64:
+		// PNG only decodes opaque images to RGBA64, so the premultiplied
+		// values are straight; anything else goes through NRGBA64 below.
+		if src.Opaque() {
+			tables := tr.decodeTables(0xffff)
+			for i := 0; i+7 < len(src.Pix); i += 8 {
+				p := src.Pix[i : i+8]
+				r, g, b := tr.rgb(
+					tables[0][uint16(p[0])<<8|uint16(p[1])],
+					tables[1][uint16(p[2])<<8|uint16(p[3])],
+					tables[2][uint16(p[4])<<8|uint16(p[5])])
+				p[0], p[1], p[2], p[3], p[4], p[5] = uint8(r>>8), uint8(r), uint8(g>>8), uint8(g), uint8(b>>8), uint8(b)
+			}
+			return src
+		}
+		b := src.Bounds()
+		nrgba64 := image.NewNRGBA64(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				nrgba64.Set(x, y, src.At(x, y))
+			}
+		}
+		return applyColorTransform(nrgba64, t)
+	}
+
+	// Everything else is 8 bits per channel.
+	nrgba := editableNRGBA(img)
+	tables := tr.decodeTables(255)
+	for i := 0; i+3 < len(nrgba.Pix); i += 4 {
+		p := nrgba.Pix[i : i+4]
+		r, g, b := tr.rgb(tables[0][p[0]], tables[1][p[1]], tables[2][p[2]])
+		p[0], p[1], p[2] = to8(r), to8(g), to8(b)
+	}
+	return nrgba
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+)
+
+type ditherMethod int
+
+const (
+	// ditherNone rounds to the nearest level.
+	ditherNone ditherMethod = iota
+	ditherOrdered
+	ditherFloydSteinberg
+	// ditherTruncate rounds down, keeping only the high bits.
+	ditherTruncate
+)
+
+func parseDither(value string) (ditherMethod, error) {
+	switch value {
+	case "none":
+		return ditherNone, nil
+	case "ordered":
+		return ditherOrdered, nil
+	case "floyd-steinberg":
+		return ditherFloydSteinberg, nil
+	}
+	return 0, fmt.Errorf("invalid dither method %q (expected none, ordered or floyd-steinberg)", value)
+}
+
+func parseReduction(value string) (ditherMethod, error) {
+	switch value {
+	case "round":
+		return ditherNone, nil
+	case "truncate":
+		return ditherTruncate, nil
+	case "ordered":
+		return ditherOrdered, nil
+	case "floyd-steinberg":
+		return ditherFloydSteinberg, nil
+	}
+	return 0, fmt.Errorf("invalid 16-bit reduction %q (expected round, truncate, ordered or floyd-steinberg)", value)
+}
+
+// bayer4 is the 4x4 ordered dither matrix.
+var bayer4 = [4][4]float32{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+// quantizer reduces channel values in [0, inMax] to levels evenly spaced
+// output levels, optionally dithering to hide banding.
+type quantizer struct {
+	method ditherMethod
+	inMax  float32
+	levels int
+}
+
+// run quantizes every channel of a width x height image. get returns the
+// input value of a channel and set receives the chosen output level.
+func (q quantizer) run(width, height, channels int, get func(x, y, c int) float32, set func(x, y, c, level int)) {
+	top := float32(q.levels - 1)
+	scale := top / q.inMax
+	truncScale := float32(q.levels) / (q.inMax + 1)
+
+	var errCur, errNext []float32
+	if q.method == ditherFloydSteinberg {
+		errCur = make([]float32, (width+2)*channels)
+		errNext = make([]float32, (width+2)*channels)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for c := 0; c < channels; c++ {
+				in := get(x, y, c)
+				v := in * scale
+				switch q.method {
+				case ditherOrdered:
+					v += (bayer4[y&3][x&3]+0.5)/16 - 0.5
+				case ditherFloydSteinberg:
+					v += errCur[(x+1)*channels+c]
+				}
+
+				level := int(v + 0.5)
+				if q.method == ditherTruncate {
+					// Keep the high bits: levels equal-width bins.
+					level = int(in * truncScale)
+				}
+				if level < 0 {
+					level = 0
+				} else if level > q.levels-1 {
+					level = q.levels - 1
+				}
+				set(x, y, c, level)
+
+				if q.method == ditherFloydSteinberg {
+					e := v - float32(level)
+					errCur[(x+2)*channels+c] += e * 7 / 16
+					errNext[x*channels+c] += e * 3 / 16
+					errNext[(x+1)*channels+c] += e * 5 / 16
+					errNext[(x+2)*channels+c] += e * 1 / 16
+				}
+			}
+		}
+		if q.method == ditherFloydSteinberg {
+			errCur, errNext = errNext, errCur
+			for i := range errNext {
+				errNext[i] = 0
+			}
+		}
+	}
+}
+
+// quantizeARGB1555 reduces nrgba in place to the values a 16-bit ARGB1555
+// TGA can hold: 5 bits per colour channel, dithered with method, and a
+// single alpha bit set where alpha is at least alphaThreshold.
+func quantizeARGB1555(nrgba *image.NRGBA, method ditherMethod, alphaThreshold uint8) {
+	w := nrgba.Bounds().Dx()
+	h := nrgba.Bounds().Dy()
+	q := quantizer{method: method, inMax: 255, levels: 32}
+	q.run(w, h, 3,
+		func(x, y, c int) float32 {
+			return float32(nrgba.Pix[y*nrgba.Stride+x*4+c])
+		},
+		func(x, y, c, level int) {
+			nrgba.Pix[y*nrgba.Stride+x*4+c] = pixel.Expand5(uint16(level))
+		})
+
+	for y := 0; y < h; y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+w*4]
+		for x := 3; x < len(row); x += 4 {
+			if row[x] >= alphaThreshold {
+				row[x] = 255
+			} else {
+				row[x] = 0
+			}
+		}
+	}
+}
+
+// reduce16 reduces a 16-bit per channel image to 8 bits per channel with
+// method, colour and alpha alike. It returns nil for images that are not
+// 16-bit; those are left to the encoder's own conversion.
+func reduce16(img image.Image, method ditherMethod) *image.NRGBA {
+	b := img.Bounds()
+	var get func(x, y, c int) float32
+	switch src := img.(type) {
+	case *image.NRGBA64:
+		get = func(x, y, c int) float32 {
+			i := src.PixOffset(b.Min.X+x, b.Min.Y+y) + c*2
+			return float32(uint16(src.Pix[i])<<8 | uint16(src.Pix[i+1]))
+		}
+	case *image.RGBA64:
+		// Un-premultiply at full precision first.
+		get = func(x, y, c int) float32 {
+			i := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			a := uint32(src.Pix[i+6])<<8 | uint32(src.Pix[i+7])
+			if c == 3 {
+				return float32(a)
+			}
+			if a == 0 {
+				return 0
+			}
+			v := uint32(src.Pix[i+c*2])<<8 | uint32(src.Pix[i+c*2+1])
+			return float32(v * 0xffff / a)
+		}
+	case *image.Gray16:
+		get = func(x, y, c int) float32 {
+			if c == 3 {
+				return 0xffff
+			}
+			i := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			return float32(uint16(src.Pix[i])<<8 | uint16(src.Pix[i+1]))
+		}
+	default:
+		return nil
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	q := quantizer{method: method, inMax: 0xffff, levels: 256}
+	q.run(b.Dx(), b.Dy(), 4, get,
+		func(x, y, c, level int) {
+			nrgba.Pix[y*nrgba.Stride+x*4+c] = uint8(level)
+		})
+	return nrgba
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestReduce16RoundAndTruncate(t *testing.T) {
+	cases := []struct {
+		in              uint16
+		round, truncate uint8
+	}{
+		{0x0000, 0x00, 0x00},
+		{0x00ff, 0x01, 0x00},
+		{0x7eff, 0x7f, 0x7e},
+		// The low byte is under half a step, so both keep the high byte.
+		{0x807f, 0x80, 0x80},
+		{0xff00, 0xfe, 0xff},
+		{0xffff, 0xff, 0xff},
+	}
+	src := image.NewGray16(image.Rect(0, 0, len(cases), 1))
+	for i, c := range cases {
+		src.SetGray16(i, 0, color.Gray16{Y: c.in})
+	}
+	round := reduce16(src, ditherNone)
+	truncate := reduce16(src, ditherTruncate)
+	for i, c := range cases {
+		if got := round.NRGBAAt(i, 0); got != (color.NRGBA{c.round, c.round, c.round, 255}) {
+			t.Errorf("round %#04x: got %v, want %#02x", c.in, got, c.round)
+		}
+		if got := truncate.NRGBAAt(i, 0); got != (color.NRGBA{c.truncate, c.truncate, c.truncate, 255}) {
+			t.Errorf("truncate %#04x: got %v, want %#02x", c.in, got, c.truncate)
+		}
+	}
+}
+
+func TestReduce16KeepsFlatFieldsFlat(t *testing.T) {
+	for _, method := range []ditherMethod{ditherNone, ditherTruncate, ditherOrdered, ditherFloydSteinberg} {
+		for _, v := range []uint8{0, 0x40, 0x80, 0xff} {
+			src := image.NewNRGBA64(image.Rect(0, 0, 16, 16))
+			c := color.NRGBA64{uint16(v) * 0x101, uint16(v) * 0x101, uint16(v) * 0x101, uint16(v) * 0x101}
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					src.SetNRGBA64(x, y, c)
+				}
+			}
+			m := reduce16(src, method)
+			for i, got := range m.Pix {
+				if got != v {
+					t.Errorf("method %d, %#02x: pixel (%d, %d) has %#02x", method, v, i/4%16, i/64, got)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestReduce16LeavesOtherImages(t *testing.T) {
+	if m := reduce16(image.NewNRGBA(image.Rect(0, 0, 1, 1)), ditherNone); m != nil {
+		t.Errorf("reduced an 8-bit image to %T", m)
+	}
+}
+
+func TestQuantizeARGB1555AlphaThreshold(t *testing.T) {
+	alphas := []uint8{0, 126, 127, 128, 255}
+	cases := []struct {
+		threshold uint8
+		want      []uint8
+	}{
+		{127, []uint8{0, 0, 255, 255, 255}},
+		{128, []uint8{0, 0, 0, 255, 255}},
+	}
+	for _, c := range cases {
+		m := image.NewNRGBA(image.Rect(0, 0, len(alphas), 1))
+		for x, a := range alphas {
+			m.SetNRGBA(x, 0, color.NRGBA{R: 200, G: 100, B: 50, A: a})
+		}
+		quantizeARGB1555(m, ditherNone, c.threshold)
+		for x, want := range c.want {
+			if got := m.NRGBAAt(x, 0).A; got != want {
+				t.Errorf("threshold %d: alpha %d became %d, want %d", c.threshold, alphas[x], got, want)
+			}
+		}
+	}
+}
+
+func TestQuantizeARGB1555ColoursFit5Bits(t *testing.T) {
+	for _, method := range []ditherMethod{ditherNone, ditherOrdered, ditherFloydSteinberg} {
+		m := image.NewNRGBA(image.Rect(0, 0, 256, 2))
+		for x := 0; x < 256; x++ {
+			for y := 0; y < 2; y++ {
+				m.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(255 - x), B: uint8(x / 2), A: 255})
+			}
+		}
+		quantizeARGB1555(m, method, 128)
+		for i, v := range m.Pix {
+			// A widened 5-bit value repeats its top bits at the bottom.
+			if i%4 != 3 && v != v&0xf8|v>>5 {
+				t.Errorf("method %d: channel value %#02x is not a widened 5-bit value", method, v)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/bmp"
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pcx"
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+// inputFormat is an image format the converter reads, recognised by the
+// bytes at the start of the data.
+type inputFormat struct {
+	name   string
+	match  func(b []byte) bool
+	decode func(r io.Reader) (image.Image, error)
+}
+
+// sniffLen is how many bytes are peeked at to identify a format, enough for
+// a TGA header.
+const sniffLen = tga.HeaderSize
+
+// magic matches data starting with m. A '?' in m matches any byte.
+func magic(m string) func(b []byte) bool {
+	return func(b []byte) bool {
+		if len(b) < len(m) {
+			return false
+		}
+		for i := 0; i < len(m); i++ {
+			if m[i] != '?' && m[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// isPCX matches the PCX manufacturer byte, a known version and RLE encoding.
+func isPCX(b []byte) bool {
+	if len(b) < 3 || b[0] != 0x0a || b[2] != 1 {
+		return false
+	}
+	switch b[1] {
+	case 0, 2, 3, 4, 5:
+		return true
+	}
+	return false
+}
+
+// isTGA matches a valid TGA header. TGA has no signature, so it is tried
+// after every other format.
+func isTGA(b []byte) bool {
+	_, err := tga.ReadHeader(bytes.NewReader(b))
+	return err == nil
+}
+
+var inputFormats = []inputFormat{
+	{"PNG", magic("\x89PNG\r\n\x1a\n"), png.Decode},
+	{"JPEG", magic("\xff\xd8"), jpeg.Decode},
+	{"GIF", magic("GIF8?a"), gif.Decode},
+	{"BMP", magic("BM"), bmp.Decode},
+	{"PCX", isPCX, pcx.Decode},
+	{"TGA", isTGA, tga.Decode},
+}
+
+// sniffFormat identifies the format of the data in br without consuming it.
+func sniffFormat(br *bufio.Reader) (inputFormat, bool) {
+	b, _ := br.Peek(sniffLen)
+	for _, f := range inputFormats {
+		if f.match(b) {
+			return f, true
+		}
+	}
+	return inputFormat{}, false
+}
+
+func formatNames() string {
+	names := make([]string, len(inputFormats))
+	for i, f := range inputFormats {
+		names[i] = f.name
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// inputImage is an image read by readImage.
+type inputImage struct {
+	img image.Image
+	// format is the name of the detected format.
+	format string
+	// colors holds the colour space chunks of PNG input, which the PNG
+	// decoder ignores.
+	colors *pngColorChunks
+}
+
+// readImage decodes an image from r, identified by its content rather than by
+// name. frame selects the frame of an animated GIF and must be 0 for other
+// formats. The image is returned as decoded, in whatever format the decoder
+// picked, and read row by row by the encoder so that no second full-size copy
+// is made.
+func readImage(r io.Reader, name string, frame int) (inputImage, error) {
+	br := bufio.NewReader(r)
+	format, ok := sniffFormat(br)
+	if !ok {
+		return inputImage{}, fmt.Errorf("unrecognised input format (expected %s): %s", formatNames(), name)
+	}
+	in := inputImage{format: format.name}
+
+	var err error
+	switch {
+	case format.name == "GIF":
+		in.img, err = decodeGIFFrame(br, frame)
+	case frame != 0:
+		return in, fmt.Errorf("--frame only applies to GIF input, %s is a %s", name, format.name)
+	case format.name == "PNG":
+		in.colors = &pngColorChunks{}
+		in.img, err = format.decode(io.TeeReader(br, in.colors))
+	default:
+		in.img, err = format.decode(br)
+	}
+	if err != nil {
+		return in, fmt.Errorf("failed to decode %s: %s: %v", format.name, name, err)
+	}
+
+	bounds := in.img.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+	if w <= 0 || h <= 0 {
+		return in, fmt.Errorf("input %s has invalid dimensions: %dx%d", format.name, w, h)
+	}
+
+	return in, nil
+}
+
+// decodeGIFFrame returns frame n of a GIF as it is displayed: every frame up
+// to n is drawn onto the logical screen in turn, honouring each frame's
+// disposal method. Areas no frame has covered are transparent.
+func decodeGIFFrame(r io.Reader, n int) (image.Image, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n >= len(g.Image) {
+		return nil, fmt.Errorf("frame %d requested, but the GIF has %d frame(s)", n, len(g.Image))
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var previous []byte
+	for i := 0; i <= n; i++ {
+		frame := g.Image[i]
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if i == n {
+			drawGIFFrame(canvas, frame)
+			break
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+		drawGIFFrame(canvas, frame)
+		switch disposal {
+		case gif.DisposalBackground:
+			// Browsers clear to transparent rather than to the background
+			// colour, and so do we.
+			clearRect(canvas, frame.Bounds())
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return canvas, nil
+}
+
+// drawGIFFrame draws the opaque pixels of frame onto canvas.
+func drawGIFFrame(canvas *image.NRGBA, frame *image.Paletted) {
+	palette := make([]color.NRGBA, len(frame.Palette))
+	for i, c := range frame.Palette {
+		palette[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
+	}
+	r := frame.Bounds().Intersect(canvas.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			idx := int(frame.ColorIndexAt(x, y))
+			if idx >= len(palette) || palette[idx].A == 0 {
+				continue
+			}
+			canvas.SetNRGBA(x, y, palette[idx])
+		}
+	}
+}
+
+// clearRect makes r transparent in canvas.
+func clearRect(canvas *image.NRGBA, r image.Rectangle) {
+	r = r.Intersect(canvas.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := canvas.PixOffset(r.Min.X, y)
+		row := canvas.Pix[i : i+r.Dx()*4]
+		for k := range row {
+			row[k] = 0
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Package bmp implements a decoder for Windows and OS/2 BMP images: 1, 4 and
+// 8-bit paletted, 16, 24 and 32-bit true-colour, RLE4, RLE8 and BITFIELDS
+// encoded.
+//
+// Importing the package registers the format with the image package.
+package bmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// A FormatError reports that the input is not a valid BMP.
+type FormatError string
+
+func (e FormatError) Error() string { return "bmp: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented
+// BMP feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "bmp: unsupported feature: " + string(e) }
+
+// maxPixels bounds the image size the decoder allocates for.
+const maxPixels = 1 << 28
+
+const (
+	fileHeaderSize = 14
+	coreHeaderSize = 12
+	infoHeaderSize = 40
+)
+
+// Compression methods.
+const (
+	biRGB            = 0
+	biRLE8           = 1
+	biRLE4           = 2
+	biBitfields      = 3
+	biAlphaBitfields = 6
+)
+
+type header struct {
+	pixelOffset uint32
+	width       int
+	height      int
+	topDown     bool
+	bpp         int
+	compression uint32
+	// masks are the red, green, blue and alpha bit masks of 16 and 32-bit
+	// pixels.
+	masks   [4]uint32
+	palette color.Palette
+}
+
+// readHeader reads the file and DIB headers, the bit masks and the palette,
+// leaving r at the byte after the palette. It returns how many bytes were
+// consumed.
+func readHeader(r io.Reader) (header, int, error) {
+	var h header
+	var b [fileHeaderSize + 4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return h, 0, truncated("header", err)
+	}
+	if b[0] != 'B' || b[1] != 'M' {
+		return h, 0, FormatError("not a BMP file")
+	}
+	h.pixelOffset = binary.LittleEndian.Uint32(b[10:])
+	dibSize := int(binary.LittleEndian.Uint32(b[14:]))
+	if dibSize < coreHeaderSize || dibSize > 1024 {
+		return h, 0, FormatError("bad DIB header size")
+	}
+	dib := make([]byte, dibSize)
+	if _, err := io.ReadFull(r, dib[4:]); err != nil {
+		return h, 0, truncated("header", err)
+	}
+	n := fileHeaderSize + dibSize
+
+	entrySize := 4
+	var colorsUsed int
+	if dibSize == coreHeaderSize {
+		h.width = int(binary.LittleEndian.Uint16(dib[4:]))
+		h.height = int(binary.LittleEndian.Uint16(dib[6:]))
+		h.bpp = int(binary.LittleEndian.Uint16(dib[10:]))
+		entrySize = 3
+	} else {
+		if dibSize < infoHeaderSize {
+			return h, 0, FormatError("bad DIB header size")
+		}
+		h.width = int(int32(binary.LittleEndian.Uint32(dib[4:])))
+		h.height = int(int32(binary.LittleEndian.Uint32(dib[8:])))
+		h.bpp = int(binary.LittleEndian.Uint16(dib[14:]))
+		h.compression = binary.LittleEndian.Uint32(dib[16:])
+		colorsUsed = int(binary.LittleEndian.Uint32(dib[32:]))
+	}
+	if h.height < 0 {
+		h.height = -h.height
+		h.topDown = true
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return h, 0, FormatError("zero or negative width or height")
+	}
+	if int64(h.width)*int64(h.height) > maxPixels {
+		return h, 0, UnsupportedError("image too large")
+	}
+
+	switch h.compression {
+	case biRGB:
+		switch h.bpp {
+		case 1, 4, 8, 24, 32:
+		case 16:
+			h.masks = [4]uint32{0x7c00, 0x03e0, 0x001f, 0}
+		default:
+			return h, 0, UnsupportedError("bit depth")
+		}
+	case biRLE8:
+		if h.bpp != 8 {
+			return h, 0, FormatError("RLE8 image that is not 8-bit")
+		}
+	case biRLE4:
+		if h.bpp != 4 {
+			return h, 0, FormatError("RLE4 image that is not 4-bit")
+		}
+	case biBitfields, biAlphaBitfields:
+		if h.bpp != 16 && h.bpp != 32 {
+			return h, 0, FormatError("BITFIELDS image that is not 16 or 32-bit")
+		}
+		count := 3
+		if h.compression == biAlphaBitfields {
+			count = 4
+		}
+		// Version 2 and later headers hold the masks themselves; the
+		// basic info header is followed by them.
+		var masks []byte
+		if dibSize >= infoHeaderSize+4*count {
+			masks = dib[infoHeaderSize:]
+		} else {
+			masks = make([]byte, 4*count)
+			if _, err := io.ReadFull(r, masks); err != nil {
+				return h, 0, truncated("bit masks", err)
+			}
+			n += len(masks)
+		}
+		for i := 0; i < count; i++ {
+			h.masks[i] = binary.LittleEndian.Uint32(masks[4*i:])
+		}
+		// Version 3 and later headers always carry an alpha mask.
+		if count == 3 && dibSize >= infoHeaderSize+16 {
+			h.masks[3] = binary.LittleEndian.Uint32(dib[infoHeaderSize+12:])
+		}
+		if h.masks[0]|h.masks[1]|h.masks[2] == 0 {
+			return h, 0, FormatError("empty bit masks")
+		}
+	default:
+		return h, 0, UnsupportedError("compression method")
+	}
+
+	if h.bpp <= 8 {
+		if colorsUsed == 0 || colorsUsed > 1<<h.bpp {
+			colorsUsed = 1 << h.bpp
+		}
+		entries := make([]byte, colorsUsed*entrySize)
+		if _, err := io.ReadFull(r, entries); err != nil {
+			return h, 0, truncated("palette", err)
+		}
+		n += len(entries)
+		h.palette = make(color.Palette, colorsUsed)
+		for i := range h.palette {
+			e := entries[i*entrySize:]
+			h.palette[i] = color.RGBA{R: e[2], G: e[1], B: e[0], A: 255}
+		}
+	}
+	return h, n, nil
+}
+
+func truncated(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError("truncated " + what)
+	}
+	return err
+}
+
+func (h header) colorModel() color.Model {
+	if h.palette != nil {
+		return h.palette
+	}
+	return color.NRGBAModel
+}
+
+// DecodeConfig returns the colour model and dimensions of a BMP image without
+// decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, _, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: h.colorModel(), Width: h.width, Height: h.height}, nil
+}
+
+// Decode reads a BMP image from r. Paletted images are returned as
+// *image.Paletted and everything else as *image.NRGBA. Alpha is only taken
+// from 16 and 32-bit images that declare an alpha mask; the fourth byte of
+// plain 32-bit pixels is ignored, as most writers leave it zero.
+func Decode(r io.Reader) (image.Image, error) {
+	h, n, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if int(h.pixelOffset) < n {
+		return nil, FormatError("pixel data overlaps the headers")
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(int(h.pixelOffset)-n)); err != nil {
+		return nil, truncated("file", err)
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	// row maps the i-th row in file order to the image row.
+	row := func(i int) int {
+		if h.topDown {
+			return i
+		}
+		return h.height - 1 - i
+	}
+
+	switch h.compression {
+	case biRLE8, biRLE4:
+		if h.topDown {
+			return nil, FormatError("top-down RLE image")
+		}
+		m := image.NewPaletted(rect, h.palette)
+		if err := decodeRLE(r, m, h.bpp); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	// Read the pixel data before allocating the image, so that a header
+	// claiming a huge image costs no more memory than the file holds.
+	// The sizes are counted in 64 bits, since a row of a wide image may not
+	// fit in an int on 32-bit platforms.
+	stride64 := (int64(h.width)*int64(h.bpp) + 31) / 32 * 4
+	size := stride64 * int64(h.height)
+	if size > math.MaxInt {
+		return nil, UnsupportedError("image too large")
+	}
+	stride := int(stride64)
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < size {
+		return nil, FormatError("truncated pixel data")
+	}
+
+	if h.palette != nil {
+		m := image.NewPaletted(rect, h.palette)
+		for i := 0; i < h.height; i++ {
+			buf := data[i*stride:]
+			dst := m.Pix[row(i)*m.Stride:]
+			for x := 0; x < h.width; x++ {
+				bit := x * h.bpp
+				idx := buf[bit/8] >> (8 - h.bpp - bit%8) & (1<<h.bpp - 1)
+				if int(idx) >= len(h.palette) {
+					return nil, FormatError("palette index out of range")
+				}
+				dst[x] = idx
+			}
+		}
+		return m, nil
+	}
+
+	m := image.NewNRGBA(rect)
+	var fields [4]field
+	for i, mask := range h.masks {
+		fields[i] = newField(mask)
+	}
+	for i := 0; i < h.height; i++ {
+		buf := data[i*stride:]
+		dst := m.Pix[row(i)*m.Stride:]
+		for x := 0; x < h.width; x++ {
+			d := dst[x*4 : x*4+4]
+			switch {
+			case h.bpp == 24 || (h.bpp == 32 && h.compression == biRGB):
+				s := buf[x*(h.bpp/8):]
+				d[0], d[1], d[2], d[3] = s[2], s[1], s[0], 255
+			default:
+				var v uint32
+				if h.bpp == 16 {
+					v = uint32(binary.LittleEndian.Uint16(buf[x*2:]))
+				} else {
+					v = binary.LittleEndian.Uint32(buf[x*4:])
+				}
+				d[0], d[1], d[2] = fields[0].value(v), fields[1].value(v), fields[2].value(v)
+				d[3] = 255
+				if h.masks[3] != 0 {
+					d[3] = fields[3].value(v)
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// field extracts one channel of a BITFIELDS pixel and widens it to 8 bits by
+// repeating its bits, the same way 16-bit TGA pixels are widened.
+type field struct {
+	mask  uint32
+	shift int
+	width int
+}
+
+func newField(mask uint32) field {
+	if mask == 0 {
+		return field{}
+	}
+	shift := bits.TrailingZeros32(mask)
+	return field{mask: mask, shift: shift, width: bits.Len32(mask >> shift)}
+}
+
+func (f field) value(v uint32) uint8 {
+	if f.width == 0 {
+		return 0
+	}
+	c := (v & f.mask) >> f.shift
+	if f.width >= 8 {
+		return uint8(c >> (f.width - 8))
+	}
+	c <<= 8 - f.width
+	for s := f.width; s < 8; s *= 2 {
+		c |= c >> s
+	}
+	return uint8(c)
+}
+
+// decodeRLE decodes RLE8 or RLE4 data into m, bottom row first. Pixels that
+// delta and end-of-line codes skip keep palette index 0.
+func decodeRLE(r io.Reader, m *image.Paletted, bpp int) error {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	next := func() (byte, error) {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, truncated("RLE data", err)
+		}
+		return b, nil
+	}
+
+	width, height := m.Rect.Dx(), m.Rect.Dy()
+	x, y := 0, height-1
+	put := func(idx byte) error {
+		if x >= width || y < 0 {
+			return FormatError("RLE data overruns image")
+		}
+		if int(idx) >= len(m.Palette) {
+			return FormatError("palette index out of range")
+		}
+		m.Pix[y*m.Stride+x] = idx
+		x++
+		return nil
+	}
+
+	for {
+		count, err := next()
+		if err != nil {
+			return err
+		}
+		value, err := next()
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			// An encoded run; RLE4 alternates between the two nibbles.
+			for i := 0; i < int(count); i++ {
+				idx := value
+				if bpp == 4 {
+					idx = value >> 4
+					if i%2 == 1 {
+						idx = value & 0x0f
+					}
+				}
+				if err := put(idx); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		switch value {
+		case 0:
+			x, y = 0, y-1
+		case 1:
+			return nil
+		case 2:
+			dx, err := next()
+			if err != nil {
+				return err
+			}
+			dy, err := next()
+			if err != nil {
+				return err
+			}
+			x += int(dx)
+			y -= int(dy)
+		default:
+			// An absolute run of value pixels, padded to a 16-bit boundary.
+			n := int(value)
+			size := n
+			if bpp == 4 {
+				size = (n + 1) / 2
+			}
+			data := make([]byte, size+size%2)
+			for i := range data {
+				if data[i], err = next(); err != nil {
+					return err
+				}
+			}
+			for i := 0; i < n; i++ {
+				var idx byte
+				switch {
+				case bpp == 8:
+					idx = data[i]
+				case i%2 == 0:
+					idx = data[i/2] >> 4
+				default:
+					idx = data[i/2] & 0x0f
+				}
+				if err := put(idx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func init() {
+	image.RegisterFormat("bmp", "BM", Decode, DecodeConfig)
+}
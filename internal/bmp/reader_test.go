@@ -0,0 +1,298 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/testimage"
+)
+
+// infoHeader returns a DIB header of the given size (40 for
+// BITMAPINFOHEADER, 108 for BITMAPV4HEADER) with masks, if any, stored in
+// it from byte 40 on.
+func infoHeader(size, width, height, bpp int, compression uint32, colorsUsed int, masks ...uint32) []byte {
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint32(b[0:], uint32(size))
+	binary.LittleEndian.PutUint32(b[4:], uint32(int32(width)))
+	binary.LittleEndian.PutUint32(b[8:], uint32(int32(height)))
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], uint16(bpp))
+	binary.LittleEndian.PutUint32(b[16:], compression)
+	binary.LittleEndian.PutUint32(b[32:], uint32(colorsUsed))
+	for i, m := range masks {
+		binary.LittleEndian.PutUint32(b[infoHeaderSize+4*i:], m)
+	}
+	return b
+}
+
+// coreHeader returns an OS/2 BITMAPCOREHEADER.
+func coreHeader(width, height, bpp int) []byte {
+	b := make([]byte, coreHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:], coreHeaderSize)
+	binary.LittleEndian.PutUint16(b[4:], uint16(width))
+	binary.LittleEndian.PutUint16(b[6:], uint16(height))
+	binary.LittleEndian.PutUint16(b[8:], 1)
+	binary.LittleEndian.PutUint16(b[10:], uint16(bpp))
+	return b
+}
+
+// bmpFile assembles a BMP from a DIB header, the bit masks and palette that
+// follow it, and pixel data starting right after them.
+func bmpFile(dib, tables, data []byte) []byte {
+	offset := fileHeaderSize + len(dib) + len(tables)
+	b := make([]byte, fileHeaderSize)
+	b[0], b[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(b[2:], uint32(offset+len(data)))
+	binary.LittleEndian.PutUint32(b[10:], uint32(offset))
+	return testimage.Cat(b, dib, tables, data)
+}
+
+// le32 returns the masks as little-endian bytes.
+func le32(masks ...uint32) []byte {
+	b := make([]byte, 4*len(masks))
+	for i, m := range masks {
+		binary.LittleEndian.PutUint32(b[4*i:], m)
+	}
+	return b
+}
+
+// palette is red, green, blue and white as BGRX entries, and corePalette the
+// same as the BGR entries of OS/2 files.
+var (
+	palette     = []byte{0, 0, 255, 0, 0, 255, 0, 0, 255, 0, 0, 0, 255, 255, 255, 0}
+	corePalette = []byte{0, 0, 255, 0, 255, 0, 255, 0, 0, 255, 255, 255}
+)
+
+var decodeTests = []struct {
+	name          string
+	file          []byte
+	width, height int
+	paletted      bool
+	// want lists the pixels from the top left, row by row.
+	want []color.NRGBA
+}{
+	{
+		name:     "1-bit",
+		file:     bmpFile(infoHeader(40, 2, 2, 1, biRGB, 2), palette[:8], []byte{0x80, 0, 0, 0, 0x40, 0, 0, 0}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Green, testimage.Red},
+	},
+	{
+		name:     "4-bit",
+		file:     bmpFile(infoHeader(40, 2, 2, 4, biRGB, 0), testimage.Cat(palette, make([]byte, 12*4)), []byte{0x23, 0, 0, 0, 0x01, 0, 0, 0}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:     "8-bit, top-down",
+		file:     bmpFile(infoHeader(40, 2, -2, 8, biRGB, 4), palette, []byte{0, 1, 0, 0, 2, 3, 0, 0}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:     "8-bit, OS/2 core header",
+		file:     bmpFile(coreHeader(2, 2, 8), testimage.Cat(corePalette, make([]byte, 252*3)), []byte{2, 3, 0, 0, 0, 1, 0, 0}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:   "16-bit, default 5-5-5 masks",
+		file:   bmpFile(infoHeader(40, 2, 2, 16, biRGB, 0), nil, []byte{0x1f, 0x00, 0xff, 0x7f, 0x00, 0x7c, 0xe0, 0x03}),
+		width:  2,
+		height: 2,
+		want:   []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:   "24-bit, padded rows",
+		file:   bmpFile(infoHeader(40, 3, 1, 24, biRGB, 0), nil, []byte{0, 0, 255, 0, 255, 0, 255, 0, 0, 0, 0, 0}),
+		width:  3,
+		height: 1,
+		want:   []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue},
+	},
+	{
+		name:   "32-bit, fourth byte ignored",
+		file:   bmpFile(infoHeader(40, 2, 1, 32, biRGB, 0), nil, []byte{0, 0, 255, 0, 0, 255, 0, 7}),
+		width:  2,
+		height: 1,
+		want:   []color.NRGBA{testimage.Red, testimage.Green},
+	},
+	{
+		name:   "16-bit BITFIELDS, 5-6-5 masks after the header",
+		file:   bmpFile(infoHeader(40, 2, 2, 16, biBitfields, 0), le32(0xf800, 0x07e0, 0x001f), []byte{0x1f, 0x00, 0xff, 0xff, 0x00, 0xf8, 0xe0, 0x07}),
+		width:  2,
+		height: 2,
+		want:   []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:   "32-bit ALPHABITFIELDS",
+		file:   bmpFile(infoHeader(40, 2, 1, 32, biAlphaBitfields, 0), le32(0xff0000, 0xff00, 0xff, 0xff000000), []byte{0, 0, 255, 255, 0, 255, 0, 128}),
+		width:  2,
+		height: 1,
+		want:   []color.NRGBA{testimage.Red, {G: 255, A: 128}},
+	},
+	{
+		name:   "32-bit BITFIELDS, V4 header with an alpha mask",
+		file:   bmpFile(infoHeader(108, 2, 1, 32, biBitfields, 0, 0xff, 0xff00, 0xff0000, 0xff000000), nil, []byte{255, 0, 0, 255, 0, 0, 255, 0}),
+		width:  2,
+		height: 1,
+		want:   []color.NRGBA{testimage.Red, {B: 255}},
+	},
+	{
+		name:   "32-bit BITFIELDS, 2-bit channels widened",
+		file:   bmpFile(infoHeader(40, 1, 1, 32, biBitfields, 0), le32(0x30, 0x0c, 0x03), []byte{0x1b, 0, 0, 0}),
+		width:  1,
+		height: 1,
+		want:   []color.NRGBA{{R: 0x55, G: 0xaa, B: 0xff, A: 255}},
+	},
+	{
+		name:     "RLE8, encoded runs and end of line",
+		file:     bmpFile(infoHeader(40, 2, 2, 8, biRLE8, 4), palette, []byte{2, 2, 0, 0, 1, 0, 1, 1, 0, 1}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.Blue},
+	},
+	{
+		name:     "RLE8, absolute run",
+		file:     bmpFile(infoHeader(40, 4, 1, 8, biRLE8, 4), palette, []byte{0, 3, 0, 1, 2, 0, 1, 3, 0, 1}),
+		width:    4,
+		height:   1,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:     "RLE8, delta",
+		file:     bmpFile(infoHeader(40, 2, 2, 8, biRLE8, 4), palette, []byte{0, 2, 1, 1, 1, 3, 0, 1}),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.White, testimage.Red, testimage.Red},
+	},
+	{
+		name:     "RLE4, encoded run",
+		file:     bmpFile(infoHeader(40, 4, 1, 4, biRLE4, 4), palette, []byte{4, 0x31, 0, 1}),
+		width:    4,
+		height:   1,
+		paletted: true,
+		want:     []color.NRGBA{testimage.White, testimage.Green, testimage.White, testimage.Green},
+	},
+	{
+		name:     "RLE4, absolute run",
+		file:     bmpFile(infoHeader(40, 4, 1, 4, biRLE4, 4), palette, []byte{0, 3, 0x01, 0x20, 1, 0x33, 0, 1}),
+		width:    4,
+		height:   1,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+}
+
+func TestDecode(t *testing.T) {
+	for _, c := range decodeTests {
+		m, err := Decode(bytes.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if _, ok := m.(*image.Paletted); ok != c.paletted {
+			t.Errorf("%s: decoded to %T", c.name, m)
+		}
+		testimage.CheckPixels(t, c.name, m, c.width, c.height, c.want)
+
+		config, err := DecodeConfig(bytes.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%s: DecodeConfig: %v", c.name, err)
+			continue
+		}
+		if config.Width != c.width || config.Height != c.height {
+			t.Errorf("%s: DecodeConfig size %dx%d", c.name, config.Width, config.Height)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	rgb := bmpFile(infoHeader(40, 2, 2, 24, biRGB, 0), nil, make([]byte, 16))
+	withDIBSize := func(size uint32) []byte {
+		b := append([]byte{}, rgb...)
+		binary.LittleEndian.PutUint32(b[fileHeaderSize:], size)
+		return b
+	}
+	withOffset := func(offset uint32) []byte {
+		b := append([]byte{}, rgb...)
+		binary.LittleEndian.PutUint32(b[10:], offset)
+		return b
+	}
+	rle8 := infoHeader(40, 2, 2, 8, biRLE8, 4)
+
+	cases := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"empty", nil, "truncated header"},
+		{"not a BMP", append([]byte("XX"), rgb[2:]...), "not a BMP"},
+		{"truncated file header", rgb[:10], "truncated header"},
+		{"truncated DIB header", rgb[:30], "truncated header"},
+		{"DIB header too small", withDIBSize(8), "bad DIB header size"},
+		{"DIB header between core and info", withDIBSize(20), "bad DIB header size"},
+		{"DIB header too large", withDIBSize(4096), "bad DIB header size"},
+		{"zero width", bmpFile(infoHeader(40, 0, 2, 24, biRGB, 0), nil, nil), "zero or negative"},
+		{"negative width", bmpFile(infoHeader(40, -2, 2, 24, biRGB, 0), nil, nil), "zero or negative"},
+		{"too large", bmpFile(infoHeader(40, 65536, 65536, 24, biRGB, 0), nil, nil), "too large"},
+		{"2-bit", bmpFile(infoHeader(40, 2, 2, 2, biRGB, 0), nil, nil), "bit depth"},
+		{"RLE8 at 4 bits", bmpFile(infoHeader(40, 2, 2, 4, biRLE8, 0), nil, nil), "RLE8 image that is not 8-bit"},
+		{"RLE4 at 8 bits", bmpFile(infoHeader(40, 2, 2, 8, biRLE4, 0), nil, nil), "RLE4 image that is not 4-bit"},
+		{"BITFIELDS at 24 bits", bmpFile(infoHeader(40, 2, 2, 24, biBitfields, 0), nil, nil), "BITFIELDS image that is not"},
+		{"truncated bit masks", bmpFile(infoHeader(40, 2, 2, 16, biBitfields, 0), le32(0xf800), nil), "truncated bit masks"},
+		{"empty bit masks", bmpFile(infoHeader(40, 2, 2, 16, biBitfields, 0), le32(0, 0, 0), nil), "empty bit masks"},
+		{"JPEG compression", bmpFile(infoHeader(40, 2, 2, 24, 4, 0), nil, nil), "compression method"},
+		{"truncated palette", bmpFile(infoHeader(40, 2, 2, 8, biRGB, 4), palette[:10], nil), "truncated palette"},
+		{"pixel data inside the headers", withOffset(20), "overlaps the headers"},
+		{"pixel data past the end", withOffset(1000), "truncated file"},
+		{"truncated pixel data", rgb[:len(rgb)-1], "truncated pixel data"},
+		// A row of 2^32+32 bits, which overflows an int on 32-bit
+		// platforms.
+		{"row wider than 2^32 bits", bmpFile(infoHeader(40, 1<<27+1, 1, 32, biRGB, 0), nil, make([]byte, 64)), "truncated pixel data"},
+		{"index past the palette", bmpFile(infoHeader(40, 2, 1, 8, biRGB, 2), palette[:8], []byte{0, 2, 0, 0}), "palette index out of range"},
+		{"RLE index past the palette", bmpFile(infoHeader(40, 2, 2, 8, biRLE8, 2), palette[:8], []byte{1, 3, 0, 1}), "palette index out of range"},
+		{"RLE overrun", bmpFile(rle8, palette, []byte{3, 0, 0, 1}), "overruns"},
+		{"RLE overrun past the top row", bmpFile(rle8, palette, []byte{0, 0, 0, 0, 0, 0, 1, 0, 0, 1}), "overruns"},
+		{"truncated RLE data", bmpFile(rle8, palette, []byte{2, 0, 0}), "truncated RLE data"},
+		{"truncated RLE absolute run", bmpFile(rle8, palette, []byte{0, 3, 0, 1}), "truncated RLE data"},
+		{"top-down RLE", bmpFile(infoHeader(40, 2, -2, 8, biRLE8, 4), palette, []byte{0, 1}), "top-down RLE"},
+	}
+	for _, c := range cases {
+		_, err := Decode(bytes.NewReader(c.file))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestDecodeHugeHeaderWithoutData(t *testing.T) {
+	for _, bpp := range []int{8, 24, 32} {
+		file := bmpFile(infoHeader(40, 16384, 16384, bpp, biRGB, 1), palette[:4], []byte{0, 0, 0, 0})
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Decode(bytes.NewReader(file))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%d-bit: decoded a truncated file", bpp)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%d-bit: allocated %d bytes for a %d-byte file", bpp, allocated, len(file))
+		}
+	}
+}
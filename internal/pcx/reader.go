@@ -0,0 +1,198 @@
+// Package pcx implements a decoder for ZSoft PCX images: 8-bit paletted with
+// a 256-colour VGA palette, and 24-bit true-colour stored as three planes.
+//
+// Importing the package registers the format with the image package.
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+)
+
+// A FormatError reports that the input is not a valid PCX.
+type FormatError string
+
+func (e FormatError) Error() string { return "pcx: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented
+// PCX feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "pcx: unsupported feature: " + string(e) }
+
+// maxPixels bounds the image size the decoder allocates for.
+const maxPixels = 1 << 28
+
+const (
+	headerSize = 128
+	// paletteSize is the size of the VGA palette at the end of 8-bit
+	// images, including its 0x0c marker byte.
+	paletteSize = 1 + 256*3
+)
+
+type header struct {
+	width        int
+	height       int
+	planes       int
+	bytesPerLine int
+}
+
+func parseHeader(b []byte) (header, error) {
+	if len(b) < headerSize {
+		return header{}, FormatError("truncated header")
+	}
+	if b[0] != 0x0a {
+		return header{}, FormatError("not a PCX file")
+	}
+	if b[2] != 1 {
+		return header{}, UnsupportedError("encoding")
+	}
+	xMin := int(binary.LittleEndian.Uint16(b[4:]))
+	yMin := int(binary.LittleEndian.Uint16(b[6:]))
+	xMax := int(binary.LittleEndian.Uint16(b[8:]))
+	yMax := int(binary.LittleEndian.Uint16(b[10:]))
+	h := header{
+		width:        xMax - xMin + 1,
+		height:       yMax - yMin + 1,
+		planes:       int(b[65]),
+		bytesPerLine: int(binary.LittleEndian.Uint16(b[66:])),
+	}
+	if h.width <= 0 || h.height <= 0 {
+		return header{}, FormatError("zero or negative width or height")
+	}
+	if int64(h.width)*int64(h.height) > maxPixels {
+		return header{}, UnsupportedError("image too large")
+	}
+	if b[3] != 8 || (h.planes != 1 && h.planes != 3) {
+		return header{}, UnsupportedError("bit depth (only 8-bit paletted and 24-bit are supported)")
+	}
+	if h.bytesPerLine < h.width {
+		return header{}, FormatError("scanline shorter than the image width")
+	}
+	// Writers pad scanlines to various lengths; the padding is skipped, but
+	// it still counts towards the buffer the decoder allocates.
+	if int64(h.planes*h.bytesPerLine)*int64(h.height) > 4*maxPixels {
+		return header{}, UnsupportedError("image too large")
+	}
+	return h, nil
+}
+
+// readPalette returns the VGA palette that ends an 8-bit image.
+func readPalette(data []byte) (color.Palette, error) {
+	if len(data) < headerSize+paletteSize || data[len(data)-paletteSize] != 0x0c {
+		return nil, FormatError("missing 256-colour palette")
+	}
+	entries := data[len(data)-paletteSize+1:]
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.RGBA{R: entries[i*3], G: entries[i*3+1], B: entries[i*3+2], A: 255}
+	}
+	return p, nil
+}
+
+// DecodeConfig returns the colour model and dimensions of a PCX image. The
+// palette of an 8-bit image is stored at the end of the file, so the whole
+// file is read.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	b := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return image.Config{}, FormatError("truncated header")
+	}
+	h, err := parseHeader(b)
+	if err != nil {
+		return image.Config{}, err
+	}
+	config := image.Config{ColorModel: color.NRGBAModel, Width: h.width, Height: h.height}
+	if h.planes == 1 {
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return image.Config{}, err
+		}
+		if config.ColorModel, err = readPalette(append(b, rest...)); err != nil {
+			return image.Config{}, err
+		}
+	}
+	return config, nil
+}
+
+// Decode reads a PCX image from r. 8-bit images are returned as
+// *image.Paletted and 24-bit images as *image.NRGBA.
+func Decode(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	h, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	var palette color.Palette
+	if h.planes == 1 {
+		if palette, err = readPalette(data); err != nil {
+			return nil, err
+		}
+	}
+
+	// Runs may cross plane and scanline boundaries, so the whole image is
+	// decoded as one stream of scanlines.
+	lineBytes := h.planes * h.bytesPerLine
+	// Every two bytes decode to at most 63, so data too short for the
+	// header's size is refused before allocating for it.
+	if int64(lineBytes)*int64(h.height) > 32*int64(len(data)-headerSize) {
+		return nil, FormatError("truncated pixel data")
+	}
+	lines := make([]byte, lineBytes*h.height)
+	src := bytes.NewReader(data[headerSize:])
+	for i := 0; i < len(lines); {
+		b, err := src.ReadByte()
+		if err != nil {
+			return nil, FormatError("truncated pixel data")
+		}
+		count := 1
+		if b&0xc0 == 0xc0 {
+			count = int(b & 0x3f)
+			if b, err = src.ReadByte(); err != nil {
+				return nil, FormatError("truncated pixel data")
+			}
+		}
+		if count > len(lines)-i {
+			count = len(lines) - i
+		}
+		for k := 0; k < count; k++ {
+			lines[i+k] = b
+		}
+		i += count
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	if palette != nil {
+		m := image.NewPaletted(rect, palette)
+		for y := 0; y < h.height; y++ {
+			copy(m.Pix[y*m.Stride:y*m.Stride+h.width], lines[y*lineBytes:])
+		}
+		return m, nil
+	}
+	m := image.NewNRGBA(rect)
+	for y := 0; y < h.height; y++ {
+		line := lines[y*lineBytes:]
+		dst := m.Pix[y*m.Stride:]
+		for x := 0; x < h.width; x++ {
+			dst[x*4] = line[x]
+			dst[x*4+1] = line[h.bytesPerLine+x]
+			dst[x*4+2] = line[2*h.bytesPerLine+x]
+			dst[x*4+3] = 255
+		}
+	}
+	return m, nil
+}
+
+func init() {
+	// Manufacturer 0x0a, a known version and RLE encoding. Version 1 is
+	// left out since it would also match colour-mapped TGAs.
+	for _, magic := range []string{"\x0a\x00\x01", "\x0a\x02\x01", "\x0a\x03\x01", "\x0a\x04\x01", "\x0a\x05\x01"} {
+		image.RegisterFormat("pcx", magic, Decode, DecodeConfig)
+	}
+}
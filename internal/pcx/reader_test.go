@@ -0,0 +1,191 @@
+package pcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/testimage"
+)
+
+// pcxFile assembles an RLE encoded, 8 bits per plane PCX. A non-nil palette
+// is appended as the VGA palette, marker byte included.
+func pcxFile(width, height, planes, bytesPerLine int, data, palette []byte) []byte {
+	b := make([]byte, headerSize)
+	b[0], b[1], b[2], b[3] = 0x0a, 5, 1, 8
+	binary.LittleEndian.PutUint16(b[8:], uint16(width-1))
+	binary.LittleEndian.PutUint16(b[10:], uint16(height-1))
+	b[65] = byte(planes)
+	binary.LittleEndian.PutUint16(b[66:], uint16(bytesPerLine))
+	b = append(b, data...)
+	if palette != nil {
+		b = append(b, 0x0c)
+		b = append(b, palette...)
+	}
+	return b
+}
+
+// vgaPalette holds red, green, blue and white followed by black.
+var vgaPalette = append([]byte{255, 0, 0, 0, 255, 0, 0, 0, 255, 255, 255, 255}, make([]byte, 252*3)...)
+
+var (
+	black = color.NRGBA{A: 255}
+	gray  = color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 255}
+)
+
+var decodeTests = []struct {
+	name          string
+	file          []byte
+	width, height int
+	paletted      bool
+	// want lists the pixels from the top left, row by row.
+	want []color.NRGBA
+}{
+	{
+		name:     "8-bit, literal bytes, padded scanlines",
+		file:     pcxFile(3, 2, 1, 4, []byte{0, 1, 2, 9, 3, 2, 1, 9}, vgaPalette),
+		width:    3,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White, testimage.Blue, testimage.Green},
+	},
+	{
+		name:     "8-bit, scanlines padded past an even length",
+		file:     pcxFile(3, 2, 1, 8, []byte{0, 1, 2, 9, 9, 9, 9, 9, 3, 2, 1, 0xc5, 9}, vgaPalette),
+		width:    3,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White, testimage.Blue, testimage.Green},
+	},
+	{
+		name: "24-bit, scanlines padded past an even length",
+		file: pcxFile(1, 1, 3, 4, []byte{
+			0xc1, 255, 7, 7, 7, // R plane and padding
+			0, 7, 7, 7,
+			0xc1, 255, 7, 7, 7,
+		}, nil),
+		width:  1,
+		height: 1,
+		want:   []color.NRGBA{{R: 255, B: 255, A: 255}},
+	},
+	{
+		name:     "8-bit, runs",
+		file:     pcxFile(3, 2, 1, 4, []byte{0xc4, 3, 0xc1, 0xc8, 1, 0xc2, 0}, vgaPalette),
+		width:    3,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.White, testimage.White, testimage.White, black, testimage.Green, testimage.Red},
+	},
+	{
+		name:     "8-bit, run across scanlines",
+		file:     pcxFile(2, 2, 1, 2, []byte{0xc4, 2}, vgaPalette),
+		width:    2,
+		height:   2,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Blue, testimage.Blue, testimage.Blue, testimage.Blue},
+	},
+	{
+		name:     "8-bit, run past the end is cut off",
+		file:     pcxFile(2, 1, 1, 2, []byte{0xff, 1}, vgaPalette),
+		width:    2,
+		height:   1,
+		paletted: true,
+		want:     []color.NRGBA{testimage.Green, testimage.Green},
+	},
+	{
+		name: "24-bit planes",
+		// Bytes of 0xc0 and up are stored as runs of one.
+		file: pcxFile(2, 2, 3, 2, []byte{
+			0xc1, 255, 0, 0, 0xc1, 255, 0, 0, // R, G and B planes of the top row
+			0, 0xc1, 255, 0, 0xc1, 255, 0xc2, 255,
+		}, nil),
+		width:  2,
+		height: 2,
+		want:   []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name:   "24-bit, run across planes and scanlines",
+		file:   pcxFile(3, 2, 3, 4, []byte{0xd8, 0x80}, nil),
+		width:  3,
+		height: 2,
+		want:   []color.NRGBA{gray, gray, gray, gray, gray, gray},
+	},
+}
+
+func TestDecode(t *testing.T) {
+	for _, c := range decodeTests {
+		m, err := Decode(bytes.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if _, ok := m.(*image.Paletted); ok != c.paletted {
+			t.Errorf("%s: decoded to %T", c.name, m)
+		}
+		testimage.CheckPixels(t, c.name, m, c.width, c.height, c.want)
+
+		config, err := DecodeConfig(bytes.NewReader(c.file))
+		if err != nil {
+			t.Errorf("%s: DecodeConfig: %v", c.name, err)
+			continue
+		}
+		if config.Width != c.width || config.Height != c.height {
+			t.Errorf("%s: DecodeConfig size %dx%d", c.name, config.Width, config.Height)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := pcxFile(2, 2, 3, 2, make([]byte, 12), nil)
+
+	cases := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"empty", nil, "truncated header"},
+		{"truncated header", valid[:100], "truncated header"},
+		{"not a PCX", testimage.Patched(valid, 0, 0x0b), "not a PCX"},
+		{"uncompressed", testimage.Patched(valid, 2, 0), "encoding"},
+		{"4 bits per plane", testimage.Patched(valid, 3, 4), "bit depth"},
+		{"4 planes", testimage.Patched(valid, 65, 4), "bit depth"},
+		{"xMin past xMax", testimage.Patched(valid, 4, 5), "zero or negative"},
+		{"too large", pcxFile(65536, 65535, 1, 65535, nil, nil), "too large"},
+		{"scanline shorter than the width", pcxFile(4, 2, 1, 3, nil, vgaPalette), "scanline shorter"},
+		{"scanlines too large in total", pcxFile(1, 65535, 3, 65535, nil, nil), "too large"},
+		{"missing palette", pcxFile(2, 2, 1, 2, make([]byte, 4), nil), "missing 256-colour palette"},
+		{"bad palette marker", append(pcxFile(2, 2, 1, 2, make([]byte, 4), nil), append([]byte{0x0d}, vgaPalette...)...), "missing 256-colour palette"},
+		{"truncated pixel data", valid[:len(valid)-1], "truncated pixel data"},
+		{"truncated run", pcxFile(2, 2, 3, 2, append(make([]byte, 11), 0xc1), nil), "truncated pixel data"},
+	}
+	for _, c := range cases {
+		_, err := Decode(bytes.NewReader(c.file))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestDecodeHugeHeaderWithoutData(t *testing.T) {
+	for _, planes := range []int{1, 3} {
+		var palette []byte
+		if planes == 1 {
+			palette = vgaPalette
+		}
+		file := pcxFile(16384, 16384, planes, 16384, []byte{0xff, 0}, palette)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Decode(bytes.NewReader(file))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%d planes: decoded a truncated file", planes)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%d planes: allocated %d bytes for a %d-byte file", planes, allocated, len(file))
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package pixel reads images as straight-alpha RGBA rows and models how the
+// TGA pixel depths store colours. It is shared by the tga package and the
+// command.
+package pixel
+
+import (
+	"image"
+	"image/color"
+)
+
+// Rows reads rows of any image.Image as straight-alpha RGBA without
+// going through premultiplied alpha where the source format allows it, so
+// semi-transparent and fully transparent pixels keep their colour.
+type Rows struct {
+	m       image.Image
+	palette []color.NRGBA
+}
+
+// NewRows returns a Rows reading m.
+func NewRows(m image.Image) *Rows {
+	c := &Rows{m: m}
+	if p, ok := m.(*image.Paletted); ok {
+		c.palette = make([]color.NRGBA, len(p.Palette))
+		for i, pc := range p.Palette {
+			c.palette[i] = color.NRGBAModel.Convert(pc).(color.NRGBA)
+		}
+	}
+	return c
+}
+
+// Row fills dst with the y-th row (counted from the top of the bounds) as
+// 4 bytes per pixel.
+func (c *Rows) Row(dst []byte, y int) {
+	b := c.m.Bounds()
+	w := b.Dx()
+	y += b.Min.Y
+
+	switch src := c.m.(type) {
+	case *image.NRGBA:
+		i := src.PixOffset(b.Min.X, y)
+		copy(dst[:w*4], src.Pix[i:i+w*4])
+	case *image.Gray:
+		i := src.PixOffset(b.Min.X, y)
+		for x, v := range src.Pix[i : i+w] {
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = v, v, v, 255
+		}
+	case *image.RGBA:
+		// Opaque PNGs decode to RGBA; only translucent pixels need to be
+		// un-premultiplied, the same way color.NRGBAModel does it.
+		i := src.PixOffset(b.Min.X, y)
+		copy(dst[:w*4], src.Pix[i:i+w*4])
+		for x := 3; x < w*4; x += 4 {
+			a := uint32(dst[x]) * 0x101
+			if a == 0xffff {
+				continue
+			}
+			if a == 0 {
+				dst[x-3], dst[x-2], dst[x-1] = 0, 0, 0
+				continue
+			}
+			for k := x - 3; k < x; k++ {
+				dst[k] = uint8((uint32(dst[k]) * 0x101 * 0xffff / a) >> 8)
+			}
+		}
+	case *image.YCbCr:
+		// JPEGs decode to YCbCr; convert without boxing every pixel.
+		for x := 0; x < w; x++ {
+			yi := src.YOffset(b.Min.X+x, y)
+			ci := src.COffset(b.Min.X+x, y)
+			r, g, bl := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = r, g, bl, 255
+		}
+	case *image.NRGBA64:
+		i := src.PixOffset(b.Min.X, y)
+		for x := 0; x < w; x++ {
+			s := src.Pix[i+x*8:]
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = s[0], s[2], s[4], s[6]
+		}
+	case *image.Paletted:
+		i := src.PixOffset(b.Min.X, y)
+		for x, idx := range src.Pix[i : i+w] {
+			var pc color.NRGBA
+			if int(idx) < len(c.palette) {
+				pc = c.palette[idx]
+			}
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = pc.R, pc.G, pc.B, pc.A
+		}
+	default:
+		for x := 0; x < w; x++ {
+			pc := color.NRGBAModel.Convert(c.m.At(b.Min.X+x, y)).(color.NRGBA)
+			dst[x*4], dst[x*4+1], dst[x*4+2], dst[x*4+3] = pc.R, pc.G, pc.B, pc.A
+		}
+	}
+}
+
+// ToNRGBA returns a straight-alpha copy of m anchored at (0, 0). Unlike
+// draw.Draw it does not round-trip NRGBA, NRGBA64 or paletted sources
+// through premultiplied alpha, so transparent pixels keep their colour.
+func ToNRGBA(m image.Image) *image.NRGBA {
+	b := m.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	c := NewRows(m)
+	for y := 0; y < b.Dy(); y++ {
+		c.Row(nrgba.Pix[y*nrgba.Stride:], y)
+	}
+	return nrgba
+}
+
+// LosslessDepth returns the smallest pixel depth that stores m without loss:
+// 8 for opaque gray images, 24 for other opaque images and 32 otherwise.
+func LosslessDepth(m image.Image) int {
+	b := m.Bounds()
+	c := NewRows(m)
+	row := make([]byte, b.Dx()*4)
+	gray := true
+	for y := 0; y < b.Dy(); y++ {
+		c.Row(row, y)
+		for x := 0; x < len(row); x += 4 {
+			if row[x+3] != 255 {
+				return 32
+			}
+			if row[x] != row[x+1] || row[x] != row[x+2] {
+				gray = false
+			}
+		}
+	}
+	if gray {
+		return 8
+	}
+	return 24
+}
+
+// EncodedColor returns c as it decodes after being encoded at the given
+// depth: reduced to luma at 8 bits, to 5 bits per channel and a single alpha
+// bit at 16 bits, and made opaque at 24 bits.
+func EncodedColor(c color.NRGBA, depth int) color.NRGBA {
+	switch depth {
+	case 8:
+		v := Luma(c.R, c.G, c.B)
+		return color.NRGBA{R: v, G: v, B: v, A: 255}
+	case 16:
+		v := PackARGB1555(c.R, c.G, c.B, c.A)
+		c = color.NRGBA{R: Expand5(v >> 10), G: Expand5(v >> 5), B: Expand5(v), A: 0}
+		if v&0x8000 != 0 {
+			c.A = 255
+		}
+	case 24:
+		c.A = 255
+	}
+	return c
+}
+
+// Luma returns the Rec. 601 luma of a colour, as 8-bit grayscale stores it.
+func Luma(r, g, b uint8) uint8 {
+	return uint8((299*uint32(r) + 587*uint32(g) + 114*uint32(b) + 500) / 1000)
+}
+
+// PackARGB1555 packs a colour into 16 bits, setting the alpha bit when alpha
+// is at least 128.
+func PackARGB1555(r, g, b, a uint8) uint16 {
+	v := uint16(r>>3)<<10 | uint16(g>>3)<<5 | uint16(b>>3)
+	if a >= 128 {
+		v |= 0x8000
+	}
+	return v
+}
+
+// Expand5 widens the low 5 bits of v to 8 bits.
+func Expand5(v uint16) uint8 {
+	v &= 0x1f
+	return uint8(v<<3 | v>>2)
+}
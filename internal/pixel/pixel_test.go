@@ -0,0 +1,38 @@
+package pixel
+
+import "testing"
+
+func TestPackARGB1555(t *testing.T) {
+	cases := []struct {
+		r, g, b, a uint8
+		want       uint16
+	}{
+		{0, 0, 0, 0, 0x0000},
+		{255, 0, 0, 255, 0xfc00},
+		{0, 255, 0, 255, 0x83e0},
+		{0, 0, 255, 255, 0x801f},
+		{255, 255, 255, 127, 0x7fff},
+		{255, 255, 255, 128, 0xffff},
+		// Only the high 5 bits of each channel are kept.
+		{0x07, 0x08, 0x0f, 0, 0x0021},
+	}
+	for _, c := range cases {
+		if got := PackARGB1555(c.r, c.g, c.b, c.a); got != c.want {
+			t.Errorf("PackARGB1555(%d, %d, %d, %d) = %#04x, want %#04x", c.r, c.g, c.b, c.a, got, c.want)
+		}
+	}
+}
+
+func TestExpand5(t *testing.T) {
+	for v := uint16(0); v < 32; v++ {
+		if got := Expand5(v) >> 3; uint16(got) != v {
+			t.Errorf("Expand5(%d) = %d does not keep the value in its high bits", v, Expand5(v))
+		}
+	}
+	if Expand5(0) != 0 || Expand5(31) != 255 {
+		t.Errorf("Expand5 maps 0 and 31 to %d and %d, want 0 and 255", Expand5(0), Expand5(31))
+	}
+	if got := Expand5(0xffe0 | 1); got != Expand5(1) {
+		t.Errorf("Expand5 reads bits above the low 5: got %d", got)
+	}
+}
@@ -0,0 +1,49 @@
+// Package testimage holds the colours and checks shared by the decoder
+// tests.
+package testimage
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	Red   = color.NRGBA{R: 255, A: 255}
+	Green = color.NRGBA{G: 255, A: 255}
+	Blue  = color.NRGBA{B: 255, A: 255}
+	White = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+// Cat concatenates parts into a new slice.
+func Cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// Patched returns a copy of b with the byte at i set to v.
+func Patched(b []byte, i int, v byte) []byte {
+	b = append([]byte{}, b...)
+	b[i] = v
+	return b
+}
+
+// CheckPixels reports, under name, bounds of m other than width x height
+// and every pixel that differs from want, which lists the pixels from the
+// top left, row by row.
+func CheckPixels(t *testing.T, name string, m image.Image, width, height int, want []color.NRGBA) {
+	t.Helper()
+	if b := m.Bounds(); b != image.Rect(0, 0, width, height) {
+		t.Errorf("%s: bounds %v, want %dx%d", name, b, width, height)
+		return
+	}
+	for i, w := range want {
+		x, y := i%width, i/width
+		if got := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA); got != w {
+			t.Errorf("%s: pixel (%d, %d) is %v, want %v", name, x, y, got, w)
+		}
+	}
+}
@@ -1,208 +1,638 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"flag"
 	"fmt"
 	"image"
-	"image/draw"
-	"image/png"
+	"image/color"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
 )
 
-func writeLE16(w io.Writer, value uint16) error {
-	bytes := [2]byte{byte(value), byte(value >> 8)}
-	_, err := w.Write(bytes[:])
-	return err
+// stdioName is the path that stands for standard input or output.
+const stdioName = "-"
+
+// displayName returns how path is shown in messages, naming standard input
+// or output as stream for "-".
+func displayName(path, stream string) string {
+	if path == stdioName {
+		return "<" + stream + ">"
+	}
+	return path
 }
 
-func loadPNGRGBA(path string) (*image.RGBA, error) {
+// openInput opens the input at path, which is standard input for "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdioName {
+		return io.NopCloser(os.Stdin), nil
+	}
 	fp, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open input PNG: %s", path)
+		return nil, fmt.Errorf("failed to open input: %s", path)
 	}
-	defer fp.Close()
+	return fp, nil
+}
 
-	img, err := png.Decode(fp)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode PNG: %s", path)
+// defaultOutputPath derives the output path from the input path by replacing
+// its extension with .tga. TGA input, whatever the case of its extension, is
+// normalised in place; standard input is written to standard output.
+func defaultOutputPath(inputPath string) string {
+	ext := filepath.Ext(inputPath)
+	if inputPath == stdioName || strings.EqualFold(ext, ".tga") {
+		return inputPath
 	}
+	return strings.TrimSuffix(inputPath, ext) + ".tga"
+}
 
-	bounds := img.Bounds()
-	w := bounds.Dx()
-	h := bounds.Dy()
-	if w <= 0 || h <= 0 {
-		return nil, fmt.Errorf("input PNG has invalid dimensions: %dx%d", w, h)
+// editableNRGBA returns img as an *image.NRGBA that may be modified in
+// place, converting it only if the decoder produced another format.
+func editableNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		return nrgba
 	}
+	return pixel.ToNRGBA(img)
+}
+
+const (
+	channelNone = iota
+	channelR
+	channelG
+	channelB
+	channelA
+	channelLuma
+)
 
-	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
-	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
-	return rgba, nil
+func parseChannel(value string) (int, error) {
+	switch value {
+	case "":
+		return channelNone, nil
+	case "r":
+		return channelR, nil
+	case "g":
+		return channelG, nil
+	case "b":
+		return channelB, nil
+	case "a":
+		return channelA, nil
+	case "luma":
+		return channelLuma, nil
+	}
+	return 0, fmt.Errorf("invalid channel %q (expected r, g, b, a or luma)", value)
 }
 
-func pixelsEqual(pixels []byte, a, b, bpp int) bool {
-	ai := a * bpp
-	bi := b * bpp
-	for i := 0; i < bpp; i++ {
-		if pixels[ai+i] != pixels[bi+i] {
-			return false
+// extractChannel replaces every pixel of nrgba in place with an opaque gray
+// taken from the given channel.
+func extractChannel(nrgba *image.NRGBA, channel int) {
+	w := nrgba.Bounds().Dx()
+	h := nrgba.Bounds().Dy()
+	for y := 0; y < h; y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+w*4]
+		for x := 0; x < len(row); x += 4 {
+			var v uint8
+			if channel == channelLuma {
+				// The same luma the encoder uses for grayscale output.
+				v = pixel.EncodedColor(color.NRGBA{R: row[x], G: row[x+1], B: row[x+2]}, 8).R
+			} else {
+				v = row[x+channel-channelR]
+			}
+			row[x] = v
+			row[x+1] = v
+			row[x+2] = v
+			row[x+3] = 255
 		}
 	}
-	return true
 }
 
-func makeBGRABottomLeft(rgba *image.RGBA) ([]byte, int, int) {
-	w := rgba.Bounds().Dx()
-	h := rgba.Bounds().Dy()
-	bpp := 4
-	pixels := make([]byte, w*h*bpp)
+type tgaCompression int
 
-	for y := 0; y < h; y++ {
-		srcY := h - 1 - y
-		srcRow := srcY * rgba.Stride
-		dstRow := y * w * bpp
-		for x := 0; x < w; x++ {
-			si := srcRow + x*bpp
-			di := dstRow + x*bpp
-			r := rgba.Pix[si]
-			g := rgba.Pix[si+1]
-			b := rgba.Pix[si+2]
-			a := rgba.Pix[si+3]
-			pixels[di] = b
-			pixels[di+1] = g
-			pixels[di+2] = r
-			pixels[di+3] = a
+const (
+	// compressionAuto uses RLE whenever the engine profile accepts it and
+	// it saves space.
+	compressionAuto tgaCompression = iota
+	compressionRLE
+	compressionNone
+)
+
+func parseCompression(value string) (tgaCompression, error) {
+	switch value {
+	case "auto":
+		return compressionAuto, nil
+	case "rle":
+		return compressionRLE, nil
+	case "none":
+		return compressionNone, nil
+	}
+	return 0, fmt.Errorf("invalid compression %q (expected auto, rle or none)", value)
+}
+
+func parseOrigin(value string) (bool, error) {
+	switch value {
+	case "bottom-left":
+		return false, nil
+	case "top-left":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid origin %q (expected bottom-left or top-left)", value)
+}
+
+// parseDepth parses a --depth value; 0 means pick the depth automatically.
+func parseDepth(value string) (int, error) {
+	switch value {
+	case "auto":
+		return 0, nil
+	case "8":
+		return 8, nil
+	case "16":
+		return 16, nil
+	case "24":
+		return 24, nil
+	case "32":
+		return 32, nil
+	}
+	return 0, fmt.Errorf("invalid depth %q (expected auto, 8, 16, 24 or 32)", value)
+}
+
+type tgaOptions struct {
+	compression tgaCompression
+	// depth is the requested pixel depth; 0 picks the smallest depth that
+	// stores the image without loss (see pixel.LosslessDepth).
+	depth int
+	// scanlineRLE keeps RLE packets within a single row; nil uses the
+	// profile's default.
+	scanlineRLE *bool
+	// topLeft stores rows top to bottom instead of idTech 3's bottom-left
+	// origin.
+	topLeft bool
+}
+
+// tgaResult describes what writeTGA wrote.
+type tgaResult struct {
+	encoding tgaEncoding
+	// pixelBytes is the size of the pixel data as written, rawBytes its
+	// size without compression.
+	pixelBytes int
+	rawBytes   int
+}
+
+func (r tgaResult) String() string {
+	if !r.encoding.rle() {
+		if r.encoding.rleFallback {
+			return fmt.Sprintf("%s, %d bytes of pixel data (RLE would not save space)", r.encoding, r.pixelBytes)
 		}
+		return fmt.Sprintf("%s, %d bytes of pixel data", r.encoding, r.pixelBytes)
+	}
+	saved := r.rawBytes - r.pixelBytes
+	if saved < 0 {
+		return fmt.Sprintf("%s, %d bytes of pixel data (%d bytes larger than uncompressed)", r.encoding, r.pixelBytes, -saved)
 	}
+	return fmt.Sprintf("%s, %d bytes of pixel data (saved %d bytes, %.1f%%)",
+		r.encoding, r.pixelBytes, saved, 100*float64(saved)/float64(r.rawBytes))
+}
 
-	return pixels, w, h
+// encodeTGA encodes img to w using the resolved encoding.
+func encodeTGA(w io.Writer, img image.Image, enc tgaEncoding, meta *tga.Metadata) (tgaResult, error) {
+	o := enc.options(meta)
+	if enc.rleFallback && enc.depth == 8 {
+		// CompressionAuto never writes RLE grayscale, which this profile
+		// loads; measure it and keep it when it is smaller.
+		probe := *o
+		probe.Compression, probe.Metadata = tga.CompressionRLE, nil
+		stats, err := tga.EncodeWithStats(io.Discard, img, &probe)
+		if err != nil {
+			return tgaResult{}, err
+		}
+		o.Compression = tga.CompressionRLE
+		if stats.PixelBytes >= stats.RawPixelBytes {
+			o.Compression = tga.CompressionNone
+		}
+	}
+	stats, err := tga.EncodeWithStats(w, img, o)
+	if err != nil {
+		return tgaResult{}, err
+	}
+	enc.imageType = stats.Header.ImageType
+	return tgaResult{encoding: enc, pixelBytes: stats.PixelBytes, rawBytes: stats.RawPixelBytes}, nil
 }
 
-func writeTGARLE(path string, rgba *image.RGBA) error {
-	pixels, width, height := makeBGRABottomLeft(rgba)
-	if width > 65535 || height > 65535 {
-		return fmt.Errorf("TGA supports up to 65535x65535 pixels")
+// writeTGA writes img to path using the resolved encoding. The file is only
+// replaced once it has been written completely and, with verify set, checked;
+// see writeFileAtomic.
+func writeTGA(path string, img image.Image, enc tgaEncoding, meta *tga.Metadata, policy outputPolicy, verify bool) (tgaResult, error) {
+	var result tgaResult
+	var check func(f *os.File) error
+	if verify {
+		check = func(f *os.File) error {
+			return verifyTGAFile(path, f, img, result.encoding, meta != nil)
+		}
 	}
+	err := writeFileAtomic(path, policy, func(w io.Writer) error {
+		var err error
+		result, err = encodeTGA(w, img, enc, meta)
+		return err
+	}, check)
+	return result, err
+}
 
-	fp, err := os.Create(path)
+// writeTGAStdout writes img to standard output. With verify set the TGA is
+// encoded into memory and checked before any of it is written, since a pipe
+// cannot be read back.
+func writeTGAStdout(img image.Image, enc tgaEncoding, meta *tga.Metadata, verify bool) (tgaResult, error) {
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return tgaResult{}, fmt.Errorf("refusing to write a TGA to a terminal; redirect standard output")
+	}
+	if !verify {
+		result, err := encodeTGA(os.Stdout, img, enc, meta)
+		if err != nil {
+			return tgaResult{}, fmt.Errorf("failed to write TGA to standard output: %v", err)
+		}
+		return result, nil
+	}
+
+	var buf bytes.Buffer
+	result, err := encodeTGA(&buf, img, enc, meta)
 	if err != nil {
-		return fmt.Errorf("failed to open output TGA: %s", path)
+		return tgaResult{}, err
+	}
+	name := displayName(stdioName, "stdout")
+	data := bytes.NewReader(buf.Bytes())
+	if err := verifyTGA(name, data, data.Size(), img, result.encoding, meta != nil); err != nil {
+		return tgaResult{}, err
 	}
-	defer fp.Close()
+	if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+		return tgaResult{}, fmt.Errorf("failed to write TGA to standard output: %v", err)
+	}
+	return result, nil
+}
 
-	writer := bufio.NewWriter(fp)
-	defer writer.Flush()
+func printUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s [options] <input|-> [output.tga|-]\n", os.Args[0])
+	fmt.Fprintf(w, "       %s %s [options] <input.tga|dir|file.pk3|-> [output.png|dir|-]\n", os.Args[0], toPNGCommand)
+	fmt.Fprintln(w, "Convert a PNG, JPEG, GIF, BMP, PCX or TGA image to an idTech 3 compatible TGA (RLE by default).")
+	fmt.Fprintf(w, "With %s, convert TGAs back to PNGs; see '%s %s --help'.\n", toPNGCommand, os.Args[0], toPNGCommand)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Options:")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Profiles:")
+	for _, p := range engineProfiles {
+		fmt.Fprintf(w, "  %-10s %s\n", p.name, p.description)
+	}
+}
 
-	if err := writer.WriteByte(0); err != nil {
-		return err
+func exitWithUsageError(msg string) {
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
 	}
-	if err := writer.WriteByte(0); err != nil {
-		return err
+	fmt.Fprintf(os.Stderr, "Usage: %s [options] <input|-> [output.tga|-]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Try '%s --help' for more information.\n", os.Args[0])
+	os.Exit(1)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == toPNGCommand {
+		runToPNG(os.Args[2:])
+		return
 	}
-	if err := writer.WriteByte(10); err != nil {
-		return err
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var (
+		flagHelp        bool
+		flagCompression string
+		flagDepth       string
+		flagChannel     string
+		flagProfile     string
+		flagMetadata    bool
+		flagAuthor      string
+		flagScanlineRLE bool
+		flagQuiet       bool
+		flagOrigin      string
+		flagVerify      bool
+		flagDither      string
+		flagAlphaThresh int
+		flagFrame       int
+		flagReduce      string
+		flagPOT         string
+		flagFilter      string
+		flagResize      string
+		flagScale       string
+		flagMaxSize     int
+		flagBleed       int
+
+		flagIgnoreColorChunks bool
+		policy                outputPolicy
+	)
+	flags.BoolVar(&flagHelp, "h", false, "Show this help and exit")
+	flags.BoolVar(&flagHelp, "help", false, "Show this help and exit (same as -h)")
+	flags.BoolVar(&flagQuiet, "q", false, "Don't report the written encoding and size")
+	flags.BoolVar(&flagQuiet, "quiet", false, "Don't report the written encoding and size (same as -q)")
+	flags.StringVar(&flagProfile, "profile", defaultProfileName, "Target engine profile that limits which TGAs may be written (see Profiles)")
+	flags.StringVar(&flagCompression, "compression", "auto", "Pixel data compression: 'auto' (RLE where the profile allows it), 'rle' (type 10/11) or 'none' (type 2/3)")
+	flags.StringVar(&flagDepth, "depth", "auto", "Pixel depth: 'auto' (8-bit if opaque gray, 24-bit if opaque, else 32-bit), '8' (grayscale), '16' (ARGB1555), '24' or '32'")
+	flags.StringVar(&flagReduce, "reduce-16bit", "round", "How 16-bit per channel input is reduced to 8 bits: 'round', 'truncate', 'ordered' or 'floyd-steinberg'")
+	flags.BoolVar(&flagIgnoreColorChunks, "ignore-color-chunks", false, "Don't convert PNGs with gAMA, cHRM or iCCP chunks to sRGB")
+	flags.StringVar(&flagDither, "dither", "none", "Dithering for 16-bit output: 'none', 'ordered' or 'floyd-steinberg'")
+	flags.IntVar(&flagAlphaThresh, "alpha-threshold", 128, "Smallest alpha (0-255) that sets the alpha bit of 16-bit output")
+	flags.StringVar(&flagOrigin, "origin", "bottom-left", "Image origin: 'bottom-left' (idTech 3) or 'top-left'")
+	flags.StringVar(&flagResize, "resize", "", "Resize to WIDTHxHEIGHT; either may be 0 to keep the aspect ratio")
+	flags.StringVar(&flagScale, "scale", "", "Resize by a factor such as 0.5 or a percentage such as 50%")
+	flags.IntVar(&flagMaxSize, "max-size", 0, "Shrink to fit within NxN, keeping the aspect ratio")
+	flags.StringVar(&flagFilter, "filter", defaultFilterName, "Resampling filter for resizing: 'box', 'bilinear', 'mitchell' or 'lanczos'")
+	flags.StringVar(&flagPOT, "pot", "warn", "Non-power-of-two sizes: 'warn', 'ignore', 'error', resize to the 'nearest', 'next' or 'previous' power of two, or 'pad-edge' or 'pad-transparent'")
+	flags.IntVar(&flagBleed, "bleed", 0, "Fill the colour of fully transparent pixels up to N pixels out from visible ones, leaving alpha untouched")
+	flags.BoolVar(&flagScanlineRLE, "scanline-rle", false, "Never let RLE packets cross a scanline (default depends on the profile)")
+	flags.BoolVar(&policy.noClobber, "no-clobber", false, "Fail instead of replacing an existing output file")
+	flags.BoolVar(&policy.force, "force", false, "Also replace write-protected output files")
+	flags.BoolVar(&policy.backup, "backup", false, "Keep an existing output file as <output>~")
+	flags.BoolVar(&flagVerify, "verify", false, "Re-read the written TGA and compare its header and every pixel with the source")
+	flags.BoolVar(&flagMetadata, "metadata", false, "Append a TGA 2.0 extension area and footer with provenance metadata")
+	flags.StringVar(&flagAuthor, "author", "", "Author name recorded with --metadata")
+	flags.IntVar(&flagFrame, "frame", 0, "Frame of an animated GIF to convert, counted from 0")
+	flags.StringVar(&flagChannel, "channel", "", "Write a single source channel as grayscale: 'r', 'g', 'b', 'a' or 'luma'")
+
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writeLE16(writer, 0); err != nil {
-		return err
+	if flagHelp {
+		printUsage(os.Stdout, flags)
+		os.Exit(0)
 	}
-	if err := writeLE16(writer, 0); err != nil {
-		return err
+
+	compression, err := parseCompression(flagCompression)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writer.WriteByte(0); err != nil {
-		return err
+	depth, err := parseDepth(flagDepth)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writeLE16(writer, 0); err != nil {
-		return err
+	channel, err := parseChannel(flagChannel)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writeLE16(writer, 0); err != nil {
-		return err
+	profile, err := findProfile(flagProfile)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writeLE16(writer, uint16(width)); err != nil {
-		return err
+	dither, err := parseDither(flagDither)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writeLE16(writer, uint16(height)); err != nil {
-		return err
+	reduction, err := parseReduction(flagReduce)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writer.WriteByte(32); err != nil {
-		return err
+	pot, err := parsePOTPolicy(flagPOT)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-	if err := writer.WriteByte(8); err != nil {
-		return err
+	filter, err := findFilter(flagFilter)
+	if err != nil {
+		exitWithUsageError(err.Error())
 	}
-
-	bpp := 4
-	pixelCount := len(pixels) / bpp
-	i := 0
-	for i < pixelCount {
-		run := 1
-		for i+run < pixelCount && run < 128 && pixelsEqual(pixels, i, i+run, bpp) {
-			run++
+	var sizing resizeOptions
+	if flagResize != "" && flagScale != "" {
+		exitWithUsageError("--resize cannot be combined with --scale")
+	}
+	if flagResize != "" {
+		if sizing.width, sizing.height, err = parseSize(flagResize); err != nil {
+			exitWithUsageError(err.Error())
 		}
+	}
+	if flagScale != "" {
+		if sizing.scale, err = parseScale(flagScale); err != nil {
+			exitWithUsageError(err.Error())
+		}
+	}
+	if flagMaxSize < 0 {
+		exitWithUsageError(fmt.Sprintf("invalid maximum size %d (expected 1 or more)", flagMaxSize))
+	}
+	sizing.maxSize = flagMaxSize
+	if flagBleed < 0 {
+		exitWithUsageError(fmt.Sprintf("invalid bleed %d (expected 0 or more)", flagBleed))
+	}
+	if flagAlphaThresh < 0 || flagAlphaThresh > 255 {
+		exitWithUsageError(fmt.Sprintf("invalid alpha threshold %d (expected 0-255)", flagAlphaThresh))
+	}
+	if flagFrame < 0 {
+		exitWithUsageError(fmt.Sprintf("invalid frame %d (expected 0 or more)", flagFrame))
+	}
+	if err := policy.validate(); err != nil {
+		exitWithUsageError(err.Error())
+	}
+	topLeft, err := parseOrigin(flagOrigin)
+	if err != nil {
+		exitWithUsageError(err.Error())
+	}
+	opts := tgaOptions{compression: compression, depth: depth, topLeft: topLeft}
+	// ditherFlags lists the 16-bit only flags given on the command line.
+	var ditherFlags []string
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "scanline-rle":
+			opts.scanlineRLE = &flagScanlineRLE
+		case "dither", "alpha-threshold":
+			ditherFlags = append(ditherFlags, "--"+f.Name)
+		}
+	})
+	if len(ditherFlags) > 0 && depth != 0 && depth != 16 {
+		exitWithUsageError(fmt.Sprintf("%s only applies to 16-bit output, not --depth %d", strings.Join(ditherFlags, " and "), depth))
+	}
 
-		if run >= 2 {
-			if err := writer.WriteByte(byte(0x80 | (run - 1))); err != nil {
-				return err
-			}
-			if _, err := writer.Write(pixels[i*bpp : i*bpp+bpp]); err != nil {
-				return err
-			}
-			i += run
-			continue
+	args := flags.Args()
+	if len(args) != 1 && len(args) != 2 {
+		exitWithUsageError("")
+	}
+
+	inputPath := args[0]
+	inputName := displayName(inputPath, "stdin")
+	outputPath := ""
+	if len(args) == 2 {
+		outputPath = args[1]
+	} else {
+		outputPath = defaultOutputPath(inputPath)
+	}
+	outputName := displayName(outputPath, "stdout")
+	if outputPath == stdioName {
+		if err := policy.validateStdout(); err != nil {
+			exitWithUsageError(err.Error())
 		}
+	}
 
-		raw := 1
-		for i+raw < pixelCount && raw < 128 {
-			if i+raw+1 < pixelCount && pixelsEqual(pixels, i+raw, i+raw+1, bpp) {
-				break
-			}
-			raw++
+	input, err := openInput(inputPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// Hash the input as it is decoded, since standard input cannot be
+	// read twice.
+	inputHash := sha256.New()
+	in, err := readImage(io.TeeReader(input, inputHash), inputName, flagFrame)
+	if err == nil && flagMetadata {
+		if _, err = io.Copy(inputHash, input); err != nil {
+			err = fmt.Errorf("failed to read input: %s", inputName)
 		}
+	}
+	input.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-		if err := writer.WriteByte(byte(raw - 1)); err != nil {
-			return err
+	img := in.img
+
+	// Convert to sRGB where the PNG says its pixels are in another colour
+	// space, before any reduction to 8 bits.
+	if in.colors != nil && !flagIgnoreColorChunks {
+		gray := false
+		switch img.(type) {
+		case *image.Gray, *image.Gray16:
+			gray = true
+		}
+		t, warnings := in.colors.colorTransform(gray)
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", inputName, warning)
 		}
-		if _, err := writer.Write(pixels[i*bpp : (i+raw)*bpp]); err != nil {
-			return err
+		if t != nil {
+			img = applyColorTransform(img, t)
+			fmt.Fprintf(os.Stderr, "%s: note: converted from %s to sRGB\n", inputName, t.source)
 		}
-		i += raw
 	}
 
-	return writer.Flush()
-}
+	// Reduce 16-bit input deliberately rather than truncating it, which
+	// bands smooth gradients.
+	reduced := false
+	if nrgba := reduce16(img, reduction); nrgba != nil {
+		img = nrgba
+		reduced = true
+	}
 
-func main() {
-	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
-		fmt.Fprintf(os.Stdout, "Usage: %s <input.png> [output.tga]\n", os.Args[0])
-		fmt.Fprintln(os.Stdout, "Convert a PNG image to an idTech 3 compatible RLE TGA.")
-		os.Exit(0)
+	if channel != channelNone {
+		nrgba := editableNRGBA(img)
+		extractChannel(nrgba, channel)
+		img = nrgba
 	}
-	if len(os.Args) != 2 && len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <input.png> [output.tga]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Try '%s --help' for more information.\n", os.Args[0])
-		os.Exit(1)
+
+	// Resize and conform the size before the encoding is chosen, since the
+	// profile's size limit applies to the result.
+	b := img.Bounds()
+	width, height := sizing.targetSize(b.Dx(), b.Dy())
+	resized := width != b.Dx() || height != b.Dy()
+	if resized {
+		img = resize(editableNRGBA(img), width, height, filter)
+		fmt.Fprintf(os.Stderr, "%s: note: resized from %dx%d to %dx%d (%s)\n", inputName, b.Dx(), b.Dy(), width, height, filter.name)
 	}
 
-	inputPath := os.Args[1]
-	outputPath := ""
-	if len(os.Args) == 3 {
-		outputPath = os.Args[2]
+	potNote := ""
+	if pot == potWarn {
+		if warning := potWarning(img, profile); warning != "" {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", inputName, warning)
+		}
 	} else {
-		if !strings.HasSuffix(inputPath, ".png") {
-			fmt.Fprintln(os.Stderr, "input must end with .png when output is not provided")
+		img, potNote, err = applyPOTPolicy(img, pot, filter)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", inputName, err)
 			os.Exit(1)
 		}
-		outputPath = strings.TrimSuffix(inputPath, ".png") + ".tga"
+		if potNote != "" {
+			fmt.Fprintf(os.Stderr, "%s: note: %s\n", inputName, potNote)
+		}
 	}
 
-	rgba, err := loadPNGRGBA(inputPath)
+	// Bleed last, so that resizing cannot pull colour back out of the
+	// transparent area.
+	if o, ok := img.(interface{ Opaque() bool }); flagBleed > 0 && !(ok && o.Opaque()) {
+		nrgba := editableNRGBA(img)
+		if n := bleedColor(nrgba, flagBleed); n > 0 {
+			fmt.Fprintf(os.Stderr, "%s: note: bled colour into %d transparent pixels\n", inputName, n)
+		}
+		img = nrgba
+	}
+
+	enc, notes, err := profile.resolveEncoding(img, opts)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", inputName, err)
 		os.Exit(1)
 	}
+	for _, note := range notes {
+		fmt.Fprintf(os.Stderr, "%s: note: %s\n", inputName, note)
+	}
+
+	if enc.depth != 16 && len(ditherFlags) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s ignored for %d-bit output\n", inputName, strings.Join(ditherFlags, " and "), enc.depth)
+	}
+	if enc.depth == 16 {
+		nrgba := editableNRGBA(img)
+		quantizeARGB1555(nrgba, dither, uint8(flagAlphaThresh))
+		img = nrgba
+	}
+
+	var meta *tga.Metadata
+	if flagMetadata {
+		settings := fmt.Sprintf("profile=%s compression=%s depth=%s origin=%s", profile.name, flagCompression, flagDepth, flagOrigin)
+		if reduced {
+			settings += " reduce-16bit=" + flagReduce
+		}
+		if in.format == "GIF" {
+			settings += fmt.Sprintf(" frame=%d", flagFrame)
+		}
+		if flagChannel != "" {
+			settings += " channel=" + flagChannel
+		}
+		if resized {
+			settings += fmt.Sprintf(" size=%dx%d", width, height)
+		}
+		if potNote != "" {
+			settings += " pot=" + flagPOT
+		}
+		if flagBleed > 0 {
+			settings += fmt.Sprintf(" bleed=%d", flagBleed)
+		}
+		if resized || (potNote != "" && pot.resizes()) {
+			settings += " filter=" + filter.name
+		}
+		if enc.depth == 16 {
+			settings += fmt.Sprintf(" dither=%s alpha-threshold=%d", flagDither, flagAlphaThresh)
+		}
+		var warnings []string
+		meta, warnings, err = newTGAMetadata(flagAuthor, inputName, inputHash.Sum(nil), settings)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(os.Stderr, "%s: warning: %s\n", inputName, warning)
+		}
+	}
 
-	if err := writeTGARLE(outputPath, rgba); err != nil {
+	var result tgaResult
+	if outputPath == stdioName {
+		result, err = writeTGAStdout(img, enc, meta, flagVerify)
+	} else {
+		result, err = writeTGA(outputPath, img, enc, meta, policy, flagVerify)
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	report := result.String()
+	if flagVerify {
+		report += ", verified"
+	}
+	if !flagQuiet {
+		// Only image data may reach standard output.
+		reportTo := os.Stdout
+		if outputPath == stdioName {
+			reportTo = os.Stderr
+		}
+		fmt.Fprintf(reportTo, "%s: %s\n", outputName, report)
+	}
 }
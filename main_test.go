@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestMain runs the command instead of the tests when runMain starts the
+// test binary again.
+func TestMain(m *testing.M) {
+	if os.Getenv("CONVERT_TEST_RUN_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the command with args in a child process and returns what it
+// wrote to standard error and its exit status.
+func runMain(t *testing.T, args ...string) (stderr string, status int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "CONVERT_TEST_RUN_MAIN=1")
+	var buf bytes.Buffer
+	cmd.Stderr = &buf
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return buf.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), 0
+}
+
+func TestStraightAlphaRoundTrip(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 128})
+	src.SetNRGBA(1, 0, color.NRGBA{R: 10, G: 20, B: 30, A: 0})
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out.tga")
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := readImage(&buf, "in.png", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeTGA(outputPath, in.img, tgaEncoding{imageType: 10, depth: 32}, nil, outputPolicy{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two differing pixels become a single raw packet right after the
+	// 18-byte header.
+	want := []byte{0x01, 50, 100, 200, 128, 30, 20, 10, 0}
+	if got := data[18:]; !bytes.Equal(got, want) {
+		t.Fatalf("pixel data = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+const (
+	toolName = "convert-png-to-idtech3-tga"
+	// toolVersion is stored as version*100 in the TGA extension area.
+	toolVersion = 100
+
+	// commentLines and commentLineSize are the number and length of the
+	// comment lines in the TGA extension area.
+	commentLines    = 4
+	commentLineSize = 80
+)
+
+// wrapWords fills lines of at most commentLineSize characters with the
+// space-separated words of text, starting the first with prefix, and stops
+// after max lines. It returns the lines and the words that did not fit.
+func wrapWords(prefix, text string, max int) (lines, rest []string) {
+	words := strings.Fields(text)
+	line := prefix
+	for len(words) > 0 {
+		word := words[0]
+		switch {
+		case line == "" || line == prefix:
+			if len(line)+len(word) > commentLineSize {
+				return lines, words
+			}
+			line += word
+		case len(line)+1+len(word) <= commentLineSize:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			if len(lines) == max {
+				return lines, words
+			}
+			line = ""
+			continue
+		}
+		words = words[1:]
+	}
+	if line != "" && line != prefix {
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// newTGAMetadata describes a conversion of the image named sourceName, whose
+// contents hash to sourceSHA256, with the given space-separated settings.
+// The settings are wrapped across the comment lines left after the source
+// and hash; settings that still do not fit are left out and reported in
+// warnings. The timestamp honours SOURCE_DATE_EPOCH so builds can be
+// reproducible.
+func newTGAMetadata(author, sourceName string, sourceSHA256 []byte, settings string) (*tga.Metadata, []string, error) {
+	timestamp := time.Now().UTC()
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %q", epoch)
+		}
+		timestamp = time.Unix(seconds, 0).UTC()
+	}
+
+	name := filepath.Base(sourceName)
+	comments := []string{
+		"source: " + name,
+		"sha256: " + hex.EncodeToString(sourceSHA256),
+	}
+	lines, rest := wrapWords("settings: ", settings, commentLines-len(comments))
+	comments = append(comments, lines...)
+	var warnings []string
+	if len(rest) > 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"settings do not fit in the TGA comment lines and are left out of the metadata: %s",
+			strings.Join(rest, " ")))
+	}
+	return &tga.Metadata{
+		Author:          author,
+		Comments:        comments,
+		Time:            timestamp,
+		JobName:         name,
+		SoftwareID:      toolName,
+		SoftwareVersion: toolVersion,
+	}, warnings, nil
+}
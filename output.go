@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// outputPolicy decides what happens to an output file that already exists.
+// The zero value replaces regular files that are writable.
+type outputPolicy struct {
+	// noClobber refuses to replace an existing file.
+	noClobber bool
+	// force also replaces write-protected files.
+	force bool
+	// backup keeps the existing file as path~.
+	backup bool
+}
+
+func (p outputPolicy) validate() error {
+	if p.noClobber && (p.force || p.backup) {
+		return errors.New("--no-clobber cannot be combined with --force or --backup")
+	}
+	return nil
+}
+
+// validateStdout rejects the flags that only apply to output files when the
+// output is standard output.
+func (p outputPolicy) validateStdout() error {
+	if p.noClobber || p.backup {
+		return errors.New("--no-clobber and --backup cannot be used when writing to standard output")
+	}
+	return nil
+}
+
+// writeFileAtomic calls write with a temporary file in the same directory as
+// path and, once everything has been written and synced, renames it into
+// place, so that a failed conversion never leaves a partial file behind. If
+// check is not nil it is called with the complete temporary file before the
+// rename; an error from it leaves the existing output untouched. A symlinked
+// output has the file it points to replaced, as writing through it would.
+func writeFileAtomic(path string, policy outputPolicy, write func(w io.Writer) error, check func(f *os.File) error) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	existing, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if policy.noClobber {
+			return fmt.Errorf("output already exists: %s", path)
+		}
+		if !existing.Mode().IsRegular() {
+			return fmt.Errorf("output exists and is not a regular file: %s", path)
+		}
+		if existing.Mode().Perm()&0o200 == 0 && !policy.force {
+			return fmt.Errorf("output exists and is write-protected: %s (use --force to replace it)", path)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("failed to stat output: %s: %v", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := createTemp(dir, filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary output in %s: %v", dir, err)
+	}
+	tmpPath := tmp.Name()
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if existing != nil {
+		// A replaced file keeps its permissions; new files get the
+		// umask's, as createTemp made them.
+		if err := tmp.Chmod(existing.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to set output permissions: %s: %v", path, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync output: %s: %v", path, err)
+	}
+	if check != nil {
+		if err := check(tmp); err != nil {
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close output: %s: %v", path, err)
+	}
+
+	if policy.noClobber {
+		// A hard link fails if path has appeared since the check above,
+		// where a rename would silently replace it.
+		if err := linkOrCopy(tmpPath, path); err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return fmt.Errorf("output already exists: %s", path)
+			}
+			return fmt.Errorf("failed to move output into place: %s: %v", path, err)
+		}
+		os.Remove(tmpPath)
+	} else {
+		if existing != nil && policy.backup {
+			// Link or copy rather than rename, so that path still
+			// exists if the rename below fails.
+			backup := path + "~"
+			if err := os.Remove(backup); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed to remove old backup: %s: %v", backup, err)
+			}
+			if err := linkOrCopy(path, backup); err != nil {
+				return fmt.Errorf("failed to back up existing output: %s: %v", path, err)
+			}
+		}
+		if err := os.Rename(tmpPath, path); err != nil {
+			return fmt.Errorf("failed to move output into place: %s: %v", path, err)
+		}
+	}
+	committed = true
+	syncDir(dir)
+	return nil
+}
+
+// link is os.Link, replaced in tests to act like a filesystem without hard
+// links.
+var link = os.Link
+
+// linkOrCopy makes newname a hard link to oldname, failing if newname
+// exists. Where the filesystem has no hard links, such as FAT, SMB shares or
+// some NFS mounts, it copies oldname to a newly created newname instead.
+func linkOrCopy(oldname, newname string) error {
+	err := link(oldname, newname)
+	if err == nil || errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	in, err := os.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(newname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(newname)
+	}
+	return err
+}
+
+// createTemp creates a new file in dir to write the output called base to.
+// Unlike os.CreateTemp, which always uses mode 0600, it creates the file
+// with mode 0666 so that the umask decides its permissions, as it would for
+// os.Create.
+func createTemp(dir, base string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		if errors.Is(err, fs.ErrExist) && try < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// syncDir makes a rename in dir durable where the platform supports syncing
+// directories; elsewhere it does nothing.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
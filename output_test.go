@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func writeString(s string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+func expectFile(t *testing.T, path, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s contains %q, want %q", path, got, want)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	testWriteFileAtomic(t)
+}
+
+// TestWriteFileAtomicWithoutHardLinks runs the same checks as if on a
+// filesystem that refuses hard links, as FAT and SMB shares do.
+func TestWriteFileAtomicWithoutHardLinks(t *testing.T) {
+	defer func(saved func(string, string) error) { link = saved }(link)
+	link = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	testWriteFileAtomic(t)
+}
+
+func testWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.tga")
+
+	if err := writeFileAtomic(path, outputPolicy{noClobber: true}, writeString("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, path, "old")
+	if err := writeFileAtomic(path, outputPolicy{noClobber: true}, writeString("new"), nil); err == nil {
+		t.Fatal("--no-clobber replaced an existing output")
+	}
+	expectFile(t, path, "old")
+
+	// A failed check happens before the rename and keeps the old output.
+	var checked string
+	failed := errors.New("check failed")
+	err := writeFileAtomic(path, outputPolicy{backup: true}, writeString("new"), func(f *os.File) error {
+		b, err := io.ReadAll(io.NewSectionReader(f, 0, 3))
+		checked = string(b)
+		if err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("got error %v, want %v", err, failed)
+	}
+	if checked != "new" {
+		t.Fatalf("check read %q, want %q", checked, "new")
+	}
+	expectFile(t, path, "old")
+	if _, err := os.Stat(path + "~"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("backup made although the check failed: %v", err)
+	}
+
+	if err := writeFileAtomic(path, outputPolicy{backup: true}, writeString("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, path, "new")
+	expectFile(t, path+"~", "old")
+
+	// An older backup is replaced.
+	if err := writeFileAtomic(path, outputPolicy{backup: true}, writeString("newer"), nil); err != nil {
+		t.Fatal(err)
+	}
+	expectFile(t, path, "newer")
+	expectFile(t, path+"~", "new")
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files left in the output directory, want 2", len(entries))
+	}
+}
+
+func TestWriteFileAtomicThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target.tga")
+	path := filepath.Join(dir, "out.tga")
+	if err := os.WriteFile(target, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.tga", path); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+
+	if err := writeFileAtomic(path, outputPolicy{}, writeString("new"), nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("the symlink was replaced by a %v file", info.Mode())
+	}
+	expectFile(t, target, "new")
+}
+
+func TestValidateStdout(t *testing.T) {
+	cases := []struct {
+		policy outputPolicy
+		ok     bool
+	}{
+		{outputPolicy{}, true},
+		{outputPolicy{force: true}, true},
+		{outputPolicy{noClobber: true}, false},
+		{outputPolicy{backup: true}, false},
+	}
+	for _, c := range cases {
+		if err := c.policy.validateStdout(); (err == nil) != c.ok {
+			t.Errorf("%+v: got error %v", c.policy, err)
+		}
+	}
+}
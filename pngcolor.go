@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxColorChunk bounds the size of a colour chunk that is kept for parsing.
+const maxColorChunk = 4 << 20
+
+// pngColorChunks collects the gAMA, cHRM, sRGB and iCCP chunks of a PNG as
+// it is streamed through Write, since image/png ignores them. Everything up
+// to the first IDAT chunk is scanned; other chunks are skipped unbuffered.
+type pngColorChunks struct {
+	gAMA, cHRM, sRGB, iCCP []byte
+
+	buf       []byte
+	signature bool
+	skip      int64
+	done      bool
+}
+
+func (p *pngColorChunks) Write(b []byte) (int, error) {
+	n := len(b)
+	for !p.done && len(b) > 0 {
+		if p.skip > 0 {
+			k := len(b)
+			if p.skip < int64(k) {
+				k = int(p.skip)
+			}
+			p.skip -= int64(k)
+			b = b[k:]
+			continue
+		}
+		p.buf = append(p.buf, b...)
+		b = nil
+		p.parse()
+	}
+	return n, nil
+}
+
+// parse consumes whole chunks from buf.
+func (p *pngColorChunks) parse() {
+	if !p.signature {
+		if len(p.buf) < len(pngSignature) {
+			return
+		}
+		p.buf = p.buf[len(pngSignature):]
+		p.signature = true
+	}
+	for len(p.buf) >= 8 {
+		length := binary.BigEndian.Uint32(p.buf)
+		if length > math.MaxInt32 {
+			// No valid PNG has such a chunk, so nothing after it can be
+			// trusted either.
+			p.done = true
+			p.buf = nil
+			return
+		}
+		kind := string(p.buf[4:8])
+		var dst *[]byte
+		switch kind {
+		case "IDAT", "IEND":
+			p.done = true
+			p.buf = nil
+			return
+		case "gAMA":
+			dst = &p.gAMA
+		case "cHRM":
+			dst = &p.cHRM
+		case "sRGB":
+			dst = &p.sRGB
+		case "iCCP":
+			dst = &p.iCCP
+		}
+		// The total is counted in 64 bits, where it cannot overflow.
+		total := 8 + int64(length) + 4
+		if dst == nil || length > maxColorChunk {
+			// Skip the chunk, including what is already buffered.
+			if total <= int64(len(p.buf)) {
+				p.buf = p.buf[total:]
+				continue
+			}
+			p.skip = total - int64(len(p.buf))
+			p.buf = p.buf[:0]
+			return
+		}
+		if int64(len(p.buf)) < total {
+			return
+		}
+		*dst = append([]byte(nil), p.buf[8:8+length]...)
+		p.buf = p.buf[total:]
+	}
+}
+
+// pngSignature starts every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// sRGBGamma is the gAMA value of sRGB-like images, 1/2.2 scaled by 100000.
+const sRGBGamma = 45455
+
+// colorTransform returns the transform that takes the PNG's pixel data to
+// sRGB, or nil if the data is already sRGB or has no colour information.
+// Problems that leave the data unconverted are returned as warnings.
+func (p *pngColorChunks) colorTransform(gray bool) (*colorTransform, []string) {
+	var warnings []string
+	// An sRGB chunk means sRGB whatever else is present; an iCCP chunk
+	// overrides gAMA and cHRM.
+	if p.sRGB != nil {
+		return nil, nil
+	}
+	if p.iCCP != nil {
+		t, err := iccTransform(p.iCCP, gray)
+		if err == nil {
+			return t, nil
+		}
+		fallback := "colours left unconverted"
+		if p.gAMA != nil || p.cHRM != nil {
+			fallback = "using gAMA/cHRM instead"
+		}
+		warnings = append(warnings, fmt.Sprintf("%v; %s", err, fallback))
+	}
+
+	t := &colorTransform{matrix: identity3}
+	var gamma float64
+	haveGamma := false
+	if len(p.gAMA) == 4 {
+		g := binary.BigEndian.Uint32(p.gAMA)
+		if g != 0 && math.Abs(float64(g)-sRGBGamma) > sRGBGamma/100 {
+			gamma = float64(g) / 100000
+			haveGamma = true
+		}
+	}
+	if haveGamma {
+		decode := func(v float64) float64 { return math.Pow(v, 1/gamma) }
+		t.decode = [3]func(float64) float64{decode, decode, decode}
+		t.source = fmt.Sprintf("gAMA %.5f", gamma)
+	} else {
+		t.decode = [3]func(float64) float64{srgbDecode, srgbDecode, srgbDecode}
+	}
+
+	haveMatrix := false
+	if len(p.cHRM) == 32 && !gray {
+		var v [8]float64
+		for i := range v {
+			v[i] = float64(binary.BigEndian.Uint32(p.cHRM[i*4:])) / 100000
+		}
+		white := xy{v[0], v[1]}
+		primaries := [3]xy{{v[2], v[3]}, {v[4], v[5]}, {v[6], v[7]}}
+		toXYZ, ok := rgbToXYZ(primaries, white)
+		if ok && white.y > 0 {
+			m := xyzToSRGB.mul(adapt(white.xyz(), whiteD65.xyz())).mul(toXYZ)
+			if !m.near(identity3, 1e-3) {
+				t.matrix = m
+				haveMatrix = true
+				if t.source != "" {
+					t.source += ", "
+				}
+				t.source += fmt.Sprintf("cHRM primaries R %.4f,%.4f G %.4f,%.4f B %.4f,%.4f white %.4f,%.4f",
+					v[2], v[3], v[4], v[5], v[6], v[7], v[0], v[1])
+			}
+		} else {
+			warnings = append(warnings, "ignoring invalid cHRM chunk")
+		}
+	}
+
+	if !haveGamma && !haveMatrix {
+		return nil, warnings
+	}
+	return t, warnings
+}
+
+// iccTransform builds a transform from an iCCP chunk. Only profiles that
+// describe sRGB, for which no transform is needed, and matrix/TRC profiles
+// are supported.
+func iccTransform(chunk []byte, gray bool) (*colorTransform, error) {
+	name, rest, ok := bytes.Cut(chunk, []byte{0})
+	if !ok || len(rest) < 1 || rest[0] != 0 {
+		return nil, fmt.Errorf("invalid iCCP chunk")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(rest[1:]))
+	if err != nil {
+		return nil, fmt.Errorf("ICC profile %q: %v", name, err)
+	}
+	profile, err := io.ReadAll(io.LimitReader(zr, maxColorChunk*4))
+	if err != nil {
+		return nil, fmt.Errorf("ICC profile %q: %v", name, err)
+	}
+	icc, err := parseICC(profile)
+	if err != nil {
+		return nil, fmt.Errorf("ICC profile %q: %v", name, err)
+	}
+	desc := icc.description
+	if desc == "" {
+		desc = string(name)
+	}
+	if strings.Contains(desc, "sRGB") || strings.Contains(string(name), "sRGB") {
+		return nil, nil
+	}
+	unsupported := func(reason string) error {
+		return fmt.Errorf("unsupported ICC profile %q (%s)", desc, reason)
+	}
+
+	switch icc.colorSpace {
+	case "GRAY":
+		if !gray {
+			return nil, unsupported("gray profile on a colour image")
+		}
+		trc, err := icc.curve("kTRC")
+		if err != nil {
+			return nil, unsupported(err.Error())
+		}
+		return &colorTransform{
+			source: fmt.Sprintf("ICC profile %q", desc),
+			decode: [3]func(float64) float64{trc, trc, trc},
+			matrix: identity3,
+		}, nil
+	case "RGB ":
+		if gray {
+			return nil, unsupported("colour profile on a gray image")
+		}
+		if _, ok := icc.tags["rTRC"]; !ok {
+			return nil, unsupported("not a matrix/TRC profile")
+		}
+	default:
+		return nil, unsupported("colour space " + strings.TrimSpace(icc.colorSpace))
+	}
+
+	t := &colorTransform{source: fmt.Sprintf("ICC profile %q", desc)}
+	var toXYZ mat3
+	for i, c := range []string{"r", "g", "b"} {
+		trc, err := icc.curve(c + "TRC")
+		if err != nil {
+			return nil, unsupported(err.Error())
+		}
+		t.decode[i] = trc
+		v, err := icc.xyz(c + "XYZ")
+		if err != nil {
+			return nil, unsupported(err.Error())
+		}
+		for k := 0; k < 3; k++ {
+			toXYZ[k][i] = v[k]
+		}
+	}
+	// Matrix/TRC colorants are adapted to the D50 connection space.
+	t.matrix = xyzToSRGB.mul(adapt(iccD50, whiteD65.xyz())).mul(toXYZ)
+	return t, nil
+}
+
+// iccProfile gives access to the tags of an ICC profile.
+type iccProfile struct {
+	colorSpace  string
+	description string
+	tags        map[string][]byte
+}
+
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("not an ICC profile")
+	}
+	p := &iccProfile{colorSpace: string(data[16:20]), tags: map[string][]byte{}}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	if count > (len(data)-132)/12 {
+		return nil, fmt.Errorf("truncated tag table")
+	}
+	for i := 0; i < count; i++ {
+		e := data[132+i*12:]
+		offset := int(binary.BigEndian.Uint32(e[4:]))
+		size := int(binary.BigEndian.Uint32(e[8:]))
+		if offset < 0 || size < 0 || offset > len(data) || size > len(data)-offset {
+			return nil, fmt.Errorf("tag outside the profile")
+		}
+		p.tags[string(e[:4])] = data[offset : offset+size]
+	}
+	p.description = parseICCText(p.tags["desc"])
+	return p, nil
+}
+
+// parseICCText decodes a textDescriptionType (version 2) or
+// multiLocalizedUnicodeType (version 4) tag, returning its first string.
+func parseICCText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > len(tag)-12 {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset > len(tag) || n > len(tag)-offset {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func (p *iccProfile) xyz(sig string) (vec3, error) {
+	tag := p.tags[sig]
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return vec3{}, fmt.Errorf("no %s tag", sig)
+	}
+	return vec3{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+// curve returns the tone reproduction curve sig as a function from encoded
+// to linear values.
+func (p *iccProfile) curve(sig string) (func(float64) float64, error) {
+	tag := p.tags[sig]
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("no %s tag", sig)
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(v float64) float64 { return v }, nil
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(v float64) float64 {
+				f := clamp01(v) * float64(n-1)
+				i := int(f)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(f-float64(i))
+			}, nil
+		}
+	case "para":
+		// Parametric curves of function types 0 to 4.
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			break
+		}
+		var a [7]float64
+		for i := 0; i < counts[kind]; i++ {
+			a[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g := a[0]
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -a[2]/a[1] {
+					return math.Pow(a[1]*x+a[2], g)
+				}
+				return 0
+			case 2:
+				if x >= -a[2]/a[1] {
+					return math.Pow(a[1]*x+a[2], g) + a[3]
+				}
+				return a[3]
+			case 3:
+				if x >= a[4] {
+					return math.Pow(a[1]*x+a[2], g)
+				}
+				return a[3] * x
+			default:
+				if x >= a[4] {
+					return math.Pow(a[1]*x+a[2], g) + a[5]
+				}
+				return a[3]*x + a[6]
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported %s curve", sig)
+}
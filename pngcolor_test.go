@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func pngChunk(length uint32, kind string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, length)
+	b = append(b, kind...)
+	b = append(b, data...)
+	return append(b, 0, 0, 0, 0)
+}
+
+func TestPNGColorChunkLengths(t *testing.T) {
+	gAMA := pngChunk(4, "gAMA", []byte{0, 0, 0xb1, 0x8f})
+
+	cases := []struct {
+		name string
+		file []byte
+		gAMA bool
+	}{
+		{"gAMA", bytes.Join([][]byte{pngSignature, gAMA}, nil), true},
+		{"length over 2^31-1 stops the scan", bytes.Join([][]byte{pngSignature, pngChunk(0x80000000, "tEXt", nil), gAMA}, nil), false},
+		{"maximum length", bytes.Join([][]byte{pngSignature, pngChunk(0xffffffff, "gAMA", nil), gAMA}, nil), false},
+		// Skipping 2^31-1 bytes must not overflow, and the skip swallows
+		// the gAMA chunk that follows.
+		{"largest valid chunk is skipped", bytes.Join([][]byte{pngSignature, pngChunk(0x7fffffff, "tEXt", nil), gAMA}, nil), false},
+		{"oversized colour chunk is skipped", bytes.Join([][]byte{pngSignature, pngChunk(maxColorChunk+1, "iCCP", nil), gAMA}, nil), false},
+	}
+	for _, c := range cases {
+		// Byte by byte as well as at once, so that chunks are split across
+		// writes.
+		for _, step := range []int{len(c.file), 1} {
+			p := &pngColorChunks{}
+			for b := c.file; len(b) > 0; {
+				n := step
+				if n > len(b) {
+					n = len(b)
+				}
+				p.Write(b[:n])
+				b = b[n:]
+			}
+			if got := p.gAMA != nil; got != c.gAMA {
+				t.Errorf("%s, %d-byte writes: gAMA found = %v, want %v", c.name, step, got, c.gAMA)
+			}
+		}
+	}
+}
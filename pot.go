@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// potPolicy decides what happens to images whose width or height is not a
+// power of two, which idTech 3 resamples when it loads them.
+type potPolicy int
+
+const (
+	// potWarn reports such images when the profile's engine resamples them.
+	potWarn potPolicy = iota
+	potIgnore
+	potError
+	// potNearest, potNext and potPrevious resample each dimension to the
+	// nearest, next larger or next smaller power of two.
+	potNearest
+	potNext
+	potPrevious
+	// potPadEdge and potPadTransparent enlarge the canvas to the next
+	// powers of two, keeping the image in the top-left corner, and fill
+	// the new area with the nearest edge pixel, either as it is or fully
+	// transparent.
+	potPadEdge
+	potPadTransparent
+)
+
+func parsePOTPolicy(value string) (potPolicy, error) {
+	switch value {
+	case "warn":
+		return potWarn, nil
+	case "ignore":
+		return potIgnore, nil
+	case "error":
+		return potError, nil
+	case "nearest":
+		return potNearest, nil
+	case "next":
+		return potNext, nil
+	case "previous":
+		return potPrevious, nil
+	case "pad-edge":
+		return potPadEdge, nil
+	case "pad-transparent":
+		return potPadTransparent, nil
+	}
+	return 0, fmt.Errorf("invalid power-of-two policy %q (expected warn, ignore, error, nearest, next, previous, pad-edge or pad-transparent)", value)
+}
+
+// resizes reports whether the policy resamples the image.
+func (p potPolicy) resizes() bool {
+	return p == potNearest || p == potNext || p == potPrevious
+}
+
+func isPowerOfTwo(n int) bool { return n > 0 && n&(n-1) == 0 }
+
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+func previousPowerOfTwo(n int) int {
+	p := nextPowerOfTwo(n)
+	if p > n {
+		p >>= 1
+	}
+	return p
+}
+
+// nearestPowerOfTwo rounds n to the closer of the neighbouring powers of
+// two, going up on a tie so that no detail is lost.
+func nearestPowerOfTwo(n int) int {
+	next, previous := nextPowerOfTwo(n), previousPowerOfTwo(n)
+	if next-n <= n-previous {
+		return next
+	}
+	return previous
+}
+
+// potWarning returns a warning about img under potWarn, or "" if profile p
+// loads it as it is.
+func potWarning(img image.Image, p *engineProfile) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if !p.powerOfTwo || (isPowerOfTwo(width) && isPowerOfTwo(height)) {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d is not a power of two; profile %s resamples it when loading, which blurs it (see --pot)",
+		width, height, p)
+}
+
+// applyPOTPolicy returns img resized with filter or padded to power-of-two
+// dimensions as policy asks, along with a note describing what was done, or
+// an error under potError. potWarn and potIgnore leave img as it is.
+func applyPOTPolicy(img image.Image, policy potPolicy, filter *resampleFilter) (image.Image, string, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if isPowerOfTwo(width) && isPowerOfTwo(height) {
+		return img, "", nil
+	}
+
+	var newWidth, newHeight int
+	switch policy {
+	case potWarn, potIgnore:
+		return img, "", nil
+	case potError:
+		return nil, "", fmt.Errorf("%dx%d is not a power of two (--pot error)", width, height)
+	case potNearest:
+		newWidth, newHeight = nearestPowerOfTwo(width), nearestPowerOfTwo(height)
+	case potNext, potPadEdge, potPadTransparent:
+		newWidth, newHeight = nextPowerOfTwo(width), nextPowerOfTwo(height)
+	case potPrevious:
+		newWidth, newHeight = previousPowerOfTwo(width), previousPowerOfTwo(height)
+	}
+
+	if policy == potPadEdge || policy == potPadTransparent {
+		padded := padImage(editableNRGBA(img), newWidth, newHeight, policy == potPadTransparent)
+		return padded, fmt.Sprintf("padded from %dx%d to %dx%d", width, height, newWidth, newHeight), nil
+	}
+	resized := resize(editableNRGBA(img), newWidth, newHeight, filter)
+	return resized, fmt.Sprintf("resized from %dx%d to %dx%d (%s)", width, height, newWidth, newHeight, filter.name), nil
+}
+
+// padImage returns src on a width x height canvas, anchored at the top left,
+// with each new pixel copied from the nearest edge pixel. With transparent
+// set the new pixels keep that colour but get zero alpha, so filtering at
+// the boundary does not darken the edge.
+func padImage(src *image.NRGBA, width, height int, transparent bool) *image.NRGBA {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := y
+		if sy >= srcH {
+			sy = srcH - 1
+		}
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+width*4]
+		i := src.PixOffset(b.Min.X, b.Min.Y+sy)
+		copy(row, src.Pix[i:i+srcW*4])
+		last := row[(srcW-1)*4 : srcW*4]
+		for x := srcW; x < width; x++ {
+			copy(row[x*4:], last)
+		}
+		if !transparent {
+			continue
+		}
+		for x := 0; x < width; x++ {
+			if x >= srcW || y >= srcH {
+				row[x*4+3] = 0
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPowerOfTwoRounding(t *testing.T) {
+	cases := []struct {
+		n                       int
+		nearest, next, previous int
+	}{
+		{1, 1, 1, 1},
+		{2, 2, 2, 2},
+		{3, 4, 4, 2}, // tie
+		{5, 4, 8, 4},
+		{6, 8, 8, 4}, // tie
+		{7, 8, 8, 4},
+		{11, 8, 16, 8},
+		{12, 16, 16, 8}, // tie
+		{13, 16, 16, 8},
+		{64, 64, 64, 64},
+		{100, 128, 128, 64},
+	}
+	for _, c := range cases {
+		if got := nearestPowerOfTwo(c.n); got != c.nearest {
+			t.Errorf("nearestPowerOfTwo(%d) = %d, want %d", c.n, got, c.nearest)
+		}
+		if got := nextPowerOfTwo(c.n); got != c.next {
+			t.Errorf("nextPowerOfTwo(%d) = %d, want %d", c.n, got, c.next)
+		}
+		if got := previousPowerOfTwo(c.n); got != c.previous {
+			t.Errorf("previousPowerOfTwo(%d) = %d, want %d", c.n, got, c.previous)
+		}
+	}
+}
+
+func TestApplyPOTPolicySizes(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 5, 12))
+	cases := []struct {
+		policy        potPolicy
+		width, height int
+	}{
+		{potWarn, 5, 12},
+		{potIgnore, 5, 12},
+		{potNearest, 4, 16},
+		{potNext, 8, 16},
+		{potPrevious, 4, 8},
+		{potPadEdge, 8, 16},
+		{potPadTransparent, 8, 16},
+	}
+	for _, c := range cases {
+		m, _, err := applyPOTPolicy(src, c.policy, resampleFilters[0])
+		if err != nil {
+			t.Errorf("policy %d: %v", c.policy, err)
+			continue
+		}
+		if b := m.Bounds(); b.Dx() != c.width || b.Dy() != c.height {
+			t.Errorf("policy %d: got %dx%d, want %dx%d", c.policy, b.Dx(), b.Dy(), c.width, c.height)
+		}
+	}
+	if _, _, err := applyPOTPolicy(src, potError, resampleFilters[0]); err == nil {
+		t.Error("potError accepted a 5x12 image")
+	}
+	if _, _, err := applyPOTPolicy(image.NewNRGBA(image.Rect(0, 0, 4, 8)), potError, resampleFilters[0]); err != nil {
+		t.Errorf("potError refused a 4x8 image: %v", err)
+	}
+}
+
+func TestPadImage(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 128}
+	blue := color.NRGBA{B: 255, A: 255}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	src.SetNRGBA(0, 0, red)
+	src.SetNRGBA(1, 0, green)
+	src.SetNRGBA(0, 1, blue)
+	src.SetNRGBA(1, 1, white)
+	transparent := func(c color.NRGBA) color.NRGBA {
+		c.A = 0
+		return c
+	}
+
+	// want lists the pixels of the 4x3 result from the top left, row by row.
+	cases := []struct {
+		transparent bool
+		want        []color.NRGBA
+	}{
+		{false, []color.NRGBA{
+			red, green, green, green,
+			blue, white, white, white,
+			blue, white, white, white,
+		}},
+		{true, []color.NRGBA{
+			red, green, transparent(green), transparent(green),
+			blue, white, transparent(white), transparent(white),
+			transparent(blue), transparent(white), transparent(white), transparent(white),
+		}},
+	}
+	for _, c := range cases {
+		m := padImage(src, 4, 3, c.transparent)
+		for i, want := range c.want {
+			if got := m.NRGBAAt(i%4, i/4); got != want {
+				t.Errorf("transparent %v: pixel (%d, %d) is %v, want %v", c.transparent, i%4, i/4, got, want)
+			}
+		}
+	}
+}
+
+func TestPOTCommandLine(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 3, 5))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(input, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out.tga")
+
+	cases := []struct {
+		args    []string
+		status  int
+		warning bool
+	}{
+		{[]string{"--pot", "error"}, 1, false},
+		{[]string{"--pot", "warn", "--profile", "q3"}, 0, true},
+		{[]string{"--pot", "warn", "--profile", "generic"}, 0, false},
+		{[]string{"--pot", "ignore", "--profile", "q3"}, 0, false},
+	}
+	for _, c := range cases {
+		stderr, status := runMain(t, append(c.args, "-q", input, output)...)
+		if status != c.status {
+			t.Errorf("%v: exit status %d, want %d (%s)", c.args, status, c.status, stderr)
+		}
+		if warned := strings.Contains(stderr, "warning: 3x5 is not a power of two"); warned != c.warning {
+			t.Errorf("%v: warned = %v, want %v: %q", c.args, warned, c.warning, stderr)
+		}
+	}
+}
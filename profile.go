@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+// engineProfile describes which TGAs an engine's image loader accepts.
+type engineProfile struct {
+	name        string
+	description string
+	// imageTypes lists the accepted TGA image types.
+	imageTypes []byte
+	// colorDepths lists the accepted pixel depths for true-colour types
+	// (2 and 10); grayscale types are always 8-bit.
+	colorDepths []int
+	// maxSize is the largest accepted width or height, 0 for no limit.
+	maxSize int
+	// topLeft is set when the loader honours the top-left origin bit; the
+	// others ignore it and load such images upside down.
+	topLeft bool
+	// powerOfTwo is set when the engine resamples textures whose width or
+	// height is not a power of two.
+	powerOfTwo bool
+	// scanlineRLE is the default for keeping RLE packets within one row.
+	// idTech 3 loaders do not care, strict TGA readers reject packets that
+	// cross scanlines.
+	scanlineRLE bool
+}
+
+var engineProfiles = []*engineProfile{
+	{
+		name:        "q3",
+		description: "vanilla Quake III Arena",
+		imageTypes:  []byte{2, 3, 10},
+		colorDepths: []int{24, 32},
+		powerOfTwo:  true,
+		// Larger textures overflow the fixed 2048 texel resample buffers.
+		maxSize: 2048,
+	},
+	{
+		name:        "ioq3",
+		description: "ioquake3",
+		imageTypes:  []byte{2, 3, 10},
+		colorDepths: []int{24, 32},
+		powerOfTwo:  true,
+	},
+	{
+		name:        "quake3e",
+		description: "Quake3e",
+		imageTypes:  []byte{2, 3, 10, 11},
+		colorDepths: []int{24, 32},
+		powerOfTwo:  true,
+		topLeft:     true,
+	},
+	{
+		name:        "wolfet",
+		description: "Wolfenstein: Enemy Territory",
+		imageTypes:  []byte{2, 3, 10},
+		colorDepths: []int{24, 32},
+		powerOfTwo:  true,
+		maxSize:     2048,
+	},
+	{
+		name:        "jka",
+		description: "Star Wars Jedi Knight: Jedi Academy",
+		imageTypes:  []byte{2, 3, 10},
+		colorDepths: []int{24, 32},
+		powerOfTwo:  true,
+		maxSize:     2048,
+	},
+	{
+		name:        "generic",
+		description: "any reader implementing the full TGA specification",
+		imageTypes:  []byte{1, 2, 3, 9, 10, 11},
+		colorDepths: []int{15, 16, 24, 32},
+		topLeft:     true,
+		scanlineRLE: true,
+	},
+}
+
+const defaultProfileName = "q3"
+
+func findProfile(name string) (*engineProfile, error) {
+	names := make([]string, 0, len(engineProfiles))
+	for _, p := range engineProfiles {
+		if p.name == name {
+			return p, nil
+		}
+		names = append(names, p.name)
+	}
+	return nil, fmt.Errorf("unknown profile %q (expected one of: %s)", name, strings.Join(names, ", "))
+}
+
+func (p *engineProfile) acceptsType(imageType byte) bool {
+	for _, t := range p.imageTypes {
+		if t == imageType {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *engineProfile) accepts(enc tgaEncoding) bool {
+	if !p.acceptsType(enc.imageType) {
+		return false
+	}
+	if enc.depth == 8 {
+		return true
+	}
+	for _, d := range p.colorDepths {
+		if d == enc.depth {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *engineProfile) String() string {
+	return fmt.Sprintf("%q (%s)", p.name, p.description)
+}
+
+// tgaEncoding is the concrete image type, pixel depth and packet layout the
+// writer emits.
+type tgaEncoding struct {
+	imageType   byte
+	depth       int
+	scanlineRLE bool
+	topLeft     bool
+	// rleFallback allows the writer to switch an RLE type to its
+	// uncompressed counterpart when RLE would not save space.
+	rleFallback bool
+}
+
+func (e tgaEncoding) rle() bool {
+	return e.imageType >= 9
+}
+
+// options returns the encoder options that write e.
+func (e tgaEncoding) options(meta *tga.Metadata) *tga.Options {
+	o := &tga.Options{
+		Depth:       e.depth,
+		TopLeft:     e.topLeft,
+		ScanlineRLE: e.scanlineRLE,
+		Metadata:    meta,
+	}
+	switch {
+	case e.rleFallback:
+		o.Compression = tga.CompressionAuto
+	case e.rle():
+		o.Compression = tga.CompressionRLE
+	default:
+		o.Compression = tga.CompressionNone
+	}
+	return o
+}
+
+func (e tgaEncoding) alphaBits() byte {
+	switch e.depth {
+	case 16:
+		return 1
+	case 32:
+		return 8
+	}
+	return 0
+}
+
+// descriptor is the image descriptor byte: alpha bits and origin.
+func (e tgaEncoding) descriptor() byte {
+	d := e.alphaBits()
+	if e.topLeft {
+		d |= 0x20
+	}
+	return d
+}
+
+func (e tgaEncoding) String() string {
+	kind := "true-colour"
+	if e.depth == 8 {
+		kind = "grayscale"
+	}
+	compression := "uncompressed"
+	if e.rle() {
+		compression = "RLE"
+	}
+	origin := "bottom-left"
+	if e.topLeft {
+		origin = "top-left"
+	}
+	return fmt.Sprintf("%d-bit %s %s (type %d, %s)", e.depth, compression, kind, e.imageType, origin)
+}
+
+// resolveEncoding picks the encoding to write img with under profile p.
+// Automatic choices silently fall back to something the engine can load;
+// explicit requests that have to be changed are reported in notes, and
+// requests that cannot be satisfied at all are rejected with an explanation.
+func (p *engineProfile) resolveEncoding(img image.Image, opts tgaOptions) (tgaEncoding, []string, error) {
+	var notes []string
+
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+	if p.maxSize > 0 && (width > p.maxSize || height > p.maxSize) {
+		return tgaEncoding{}, nil, fmt.Errorf(
+			"%dx%d image cannot be loaded by profile %s: textures are limited to %dx%d",
+			width, height, p, p.maxSize, p.maxSize)
+	}
+	if opts.topLeft && !p.topLeft {
+		return tgaEncoding{}, nil, fmt.Errorf(
+			"profile %s ignores the top-left origin bit and would load the texture upside down; use --origin bottom-left",
+			p)
+	}
+
+	natural := pixel.LosslessDepth(img)
+	var depths []int
+	if opts.depth != 0 {
+		depths = []int{opts.depth}
+	} else {
+		switch natural {
+		case 8:
+			depths = []int{8, 24, 32}
+		case 24:
+			depths = []int{24, 32}
+		default:
+			depths = []int{32}
+		}
+	}
+
+	var candidates []tgaEncoding
+	for _, depth := range depths {
+		rleType, rawType := byte(10), byte(2)
+		if depth == 8 {
+			rleType, rawType = 11, 3
+		}
+		switch opts.compression {
+		case compressionRLE:
+			candidates = append(candidates, tgaEncoding{imageType: rleType, depth: depth})
+		case compressionNone:
+			candidates = append(candidates, tgaEncoding{imageType: rawType, depth: depth})
+		default:
+			candidates = append(candidates,
+				tgaEncoding{imageType: rleType, depth: depth},
+				tgaEncoding{imageType: rawType, depth: depth})
+		}
+	}
+
+	for _, enc := range candidates {
+		if !p.accepts(enc) {
+			continue
+		}
+		// Only changes to what was asked for explicitly are worth a note.
+		depthChanged := opts.depth != 0 && enc.depth != opts.depth
+		compressionChanged := (opts.compression == compressionRLE && !enc.rle()) ||
+			(opts.compression == compressionNone && enc.rle())
+		if depthChanged || compressionChanged {
+			notes = append(notes, fmt.Sprintf(
+				"profile %s cannot load %s; writing %s instead",
+				p, candidates[0], enc))
+		}
+		enc.rleFallback = enc.rle() && opts.compression == compressionAuto && p.acceptsType(enc.imageType-8)
+		enc.topLeft = opts.topLeft
+		enc.scanlineRLE = p.scanlineRLE
+		if opts.scanlineRLE != nil {
+			enc.scanlineRLE = *opts.scanlineRLE
+		}
+		switch {
+		case enc.depth == 8 && natural != 8:
+			notes = append(notes, "colour and alpha are reduced to 8-bit grayscale")
+		case enc.depth == 24 && natural == 32:
+			notes = append(notes, "alpha channel is dropped in 24-bit output")
+		}
+		return enc, notes, nil
+	}
+
+	return tgaEncoding{}, nil, fmt.Errorf(
+		"profile %s cannot load %s: it accepts image types %s at %s bits per true-colour pixel",
+		p, candidates[0], joinInts(p.imageTypes), joinInts(p.colorDepths))
+}
+
+func joinInts[T byte | int](values []T) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// resampleFilter is a separable reconstruction filter.
+type resampleFilter struct {
+	name string
+	// support is the radius of the kernel when not downscaling.
+	support float64
+	kernel  func(x float64) float64
+}
+
+var resampleFilters = []*resampleFilter{
+	{
+		name:    "box",
+		support: 0.5,
+		kernel: func(x float64) float64 {
+			if x >= -0.5 && x < 0.5 {
+				return 1
+			}
+			return 0
+		},
+	},
+	{
+		name:    "bilinear",
+		support: 1,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x < 1 {
+				return 1 - x
+			}
+			return 0
+		},
+	},
+	{
+		// Mitchell-Netravali with B = C = 1/3.
+		name:    "mitchell",
+		support: 2,
+		kernel: func(x float64) float64 {
+			const b, c = 1.0 / 3, 1.0 / 3
+			x = math.Abs(x)
+			switch {
+			case x < 1:
+				return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+			case x < 2:
+				return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+			}
+			return 0
+		},
+	},
+	{
+		// Three-lobed Lanczos.
+		name:    "lanczos",
+		support: 3,
+		kernel: func(x float64) float64 {
+			x = math.Abs(x)
+			if x >= 3 {
+				return 0
+			}
+			return sinc(x) * sinc(x/3)
+		},
+	},
+}
+
+const defaultFilterName = "mitchell"
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+func findFilter(name string) (*resampleFilter, error) {
+	names := make([]string, 0, len(resampleFilters))
+	for _, f := range resampleFilters {
+		if f.name == name {
+			return f, nil
+		}
+		names = append(names, f.name)
+	}
+	return nil, fmt.Errorf("invalid filter %q (expected %s)", name, strings.Join(names, ", "))
+}
+
+// resizeOptions are the --resize, --scale and --max-size settings; zero
+// values are unset.
+type resizeOptions struct {
+	width, height int
+	scale         float64
+	maxSize       int
+}
+
+// parseSize parses a --resize value of the form WxH, where either side may
+// be 0 to keep the aspect ratio.
+func parseSize(value string) (width, height int, err error) {
+	w, h, ok := strings.Cut(value, "x")
+	if ok {
+		width, err = strconv.Atoi(w)
+		if err == nil {
+			height, err = strconv.Atoi(h)
+		}
+	}
+	if !ok || err != nil || width < 0 || height < 0 || width+height == 0 {
+		return 0, 0, fmt.Errorf("invalid size %q (expected WIDTHxHEIGHT, either of which may be 0 to keep the aspect ratio)", value)
+	}
+	return width, height, nil
+}
+
+// parseScale parses a --scale value, a factor such as 0.5 or a percentage
+// such as 50%.
+func parseScale(value string) (float64, error) {
+	v, percent := strings.CutSuffix(value, "%")
+	scale, err := strconv.ParseFloat(v, 64)
+	if percent {
+		scale /= 100
+	}
+	if err != nil || !(scale > 0) || math.IsInf(scale, 0) {
+		return 0, fmt.Errorf("invalid scale %q (expected a positive factor or percentage)", value)
+	}
+	return scale, nil
+}
+
+// targetSize returns the size an image of width x height is resized to.
+func (o resizeOptions) targetSize(width, height int) (int, int) {
+	newWidth, newHeight := width, height
+	switch {
+	case o.width > 0 && o.height > 0:
+		newWidth, newHeight = o.width, o.height
+	case o.width > 0:
+		newWidth, newHeight = o.width, scaled(height, float64(o.width)/float64(width))
+	case o.height > 0:
+		newWidth, newHeight = scaled(width, float64(o.height)/float64(height)), o.height
+	case o.scale > 0:
+		newWidth, newHeight = scaled(width, o.scale), scaled(height, o.scale)
+	}
+	if o.maxSize > 0 && (newWidth > o.maxSize || newHeight > o.maxSize) {
+		// Fit the longer side, keeping the aspect ratio.
+		if newWidth >= newHeight {
+			newWidth, newHeight = o.maxSize, scaled(newHeight, float64(o.maxSize)/float64(newWidth))
+		} else {
+			newWidth, newHeight = scaled(newWidth, float64(o.maxSize)/float64(newHeight)), o.maxSize
+		}
+	}
+	return newWidth, newHeight
+}
+
+// scaled returns n scaled by f, rounded and at least 1.
+func scaled(n int, f float64) int {
+	if v := int(math.Round(float64(n) * f)); v > 1 {
+		return v
+	}
+	return 1
+}
+
+// tap is one source sample contributing to an output sample.
+type tap struct {
+	index  int
+	weight float32
+}
+
+// filterTaps returns, for each of dstLen output samples, the source samples
+// that contribute to it and their normalised weights. When downscaling the
+// kernel is widened by the scale factor so every source sample is covered;
+// samples beyond the edges repeat the edge.
+func filterTaps(srcLen, dstLen int, f *resampleFilter) [][]tap {
+	scale := float64(srcLen) / float64(dstLen)
+	filterScale := math.Max(scale, 1)
+	radius := f.support * filterScale
+	taps := make([][]tap, dstLen)
+	for i := range taps {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := int(math.Ceil(center - radius))
+		last := int(math.Floor(center + radius))
+		var sum float64
+		weights := make([]float64, 0, last-first+1)
+		for j := first; j <= last; j++ {
+			w := f.kernel((float64(j) - center) / filterScale)
+			weights = append(weights, w)
+			sum += w
+		}
+		for k, w := range weights {
+			if w == 0 {
+				continue
+			}
+			j := first + k
+			if j < 0 {
+				j = 0
+			} else if j >= srcLen {
+				j = srcLen - 1
+			}
+			taps[i] = append(taps[i], tap{index: j, weight: float32(w / sum)})
+		}
+	}
+	return taps
+}
+
+// linearTable holds the linear light value of each sRGB-encoded byte.
+var linearTable = func() (t [256]float32) {
+	for i := range t {
+		t[i] = float32(srgbDecode(float64(i) / 255))
+	}
+	return t
+}()
+
+// encodeBits sets the size of the table that sRGB-encodes linear values
+// back to bytes.
+const encodeBits = 16
+
+var encodeTable = func() []uint8 {
+	t := make([]uint8, 1<<encodeBits)
+	for i := range t {
+		t[i] = uint8(math.Round(srgbEncode(float64(i)/float64(len(t)-1)) * 255))
+	}
+	return t
+}()
+
+// encodeLinear sRGB-encodes a linear value, clamping the overshoot of
+// filters with negative lobes.
+func encodeLinear(v float32) uint8 {
+	if v <= 0 || v != v {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return encodeTable[int(v*float32(len(encodeTable)-1)+0.5)]
+}
+
+// resize resamples src to width x height with filter f. Colour is filtered
+// in linear light, so that averaging does not darken it, and weighted by
+// alpha, so that the colour of transparent pixels does not bleed into
+// visible ones; pixels that end up fully transparent keep the unweighted
+// average colour instead of turning black. Alpha is filtered as it is.
+func resize(src *image.NRGBA, width, height int, f *resampleFilter) *image.NRGBA {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+	xTaps := filterTaps(srcW, width, f)
+	yTaps := filterTaps(srcH, height, f)
+
+	// Resample rows first into premultiplied floats, then columns.
+	tmp := make([]float32, width*srcH*4)
+	for y := 0; y < srcH; y++ {
+		row := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+		out := tmp[y*width*4:]
+		for x, taps := range xTaps {
+			var r, g, bl, a float32
+			for _, t := range taps {
+				p := row[t.index*4:]
+				w := t.weight * float32(p[3])
+				r += w * linearTable[p[0]]
+				g += w * linearTable[p[1]]
+				bl += w * linearTable[p[2]]
+				a += t.weight * float32(p[3])
+			}
+			out[x*4], out[x*4+1], out[x*4+2], out[x*4+3] = r, g, bl, a
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y, taps := range yTaps {
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, bl, a float32
+			for _, t := range taps {
+				p := tmp[(t.index*width+x)*4:]
+				r += t.weight * p[0]
+				g += t.weight * p[1]
+				bl += t.weight * p[2]
+				a += t.weight * p[3]
+			}
+			if a < 0.5 {
+				// Transparent after rounding: there is no weighted colour
+				// to recover, so average the colour itself.
+				r, g, bl = unweightedColor(src, xTaps[x], taps)
+				a = 0
+			} else {
+				r, g, bl = r/a, g/a, bl/a
+			}
+			out[x*4] = encodeLinear(r)
+			out[x*4+1] = encodeLinear(g)
+			out[x*4+2] = encodeLinear(bl)
+			out[x*4+3] = clampByte(a)
+		}
+	}
+	return dst
+}
+
+// unweightedColor filters the colour of src around one output pixel without
+// weighting it by alpha.
+func unweightedColor(src *image.NRGBA, xTaps, yTaps []tap) (r, g, b float32) {
+	origin := src.Bounds().Min
+	for _, ty := range yTaps {
+		row := src.Pix[src.PixOffset(origin.X, origin.Y+ty.index):]
+		for _, tx := range xTaps {
+			w := tx.weight * ty.weight
+			p := row[tx.index*4:]
+			r += w * linearTable[p[0]]
+			g += w * linearTable[p[1]]
+			b += w * linearTable[p[2]]
+		}
+	}
+	return r, g, b
+}
+
+func clampByte(v float32) uint8 {
+	if v <= 0 || v != v {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
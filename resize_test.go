@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestFilterTapsSumToOne(t *testing.T) {
+	sizes := [][2]int{{10, 10}, {10, 3}, {3, 10}, {256, 17}, {17, 256}, {1, 5}, {5, 1}}
+	for _, f := range resampleFilters {
+		for _, size := range sizes {
+			for i, taps := range filterTaps(size[0], size[1], f) {
+				var sum float64
+				for _, t := range taps {
+					sum += float64(t.weight)
+				}
+				if math.Abs(sum-1) > 1e-5 {
+					t.Errorf("%s, %d to %d: weights of sample %d sum to %v", f.name, size[0], size[1], i, sum)
+				}
+			}
+		}
+	}
+}
+
+func TestTargetSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		options       resizeOptions
+		width, height int
+		wantW, wantH  int
+	}{
+		{"unset", resizeOptions{}, 300, 200, 300, 200},
+		{"both sides", resizeOptions{width: 64, height: 32}, 300, 200, 64, 32},
+		{"height 0 keeps the aspect ratio", resizeOptions{width: 150}, 300, 200, 150, 100},
+		{"width 0 keeps the aspect ratio", resizeOptions{height: 50}, 300, 200, 75, 50},
+		{"at least 1 pixel", resizeOptions{width: 1}, 300, 2, 1, 1},
+		{"scale", resizeOptions{scale: 0.5}, 300, 200, 150, 100},
+		{"max size fits the longer side", resizeOptions{maxSize: 100}, 300, 200, 100, 67},
+		{"max size fits a tall image", resizeOptions{maxSize: 100}, 200, 300, 67, 100},
+		{"max size leaves smaller images alone", resizeOptions{maxSize: 512}, 300, 200, 300, 200},
+		{"max size leaves an exact fit alone", resizeOptions{maxSize: 300}, 300, 200, 300, 200},
+		{"max size after scale", resizeOptions{scale: 2, maxSize: 400}, 300, 200, 400, 267},
+	}
+	for _, c := range cases {
+		if w, h := c.options.targetSize(c.width, c.height); w != c.wantW || h != c.wantH {
+			t.Errorf("%s: %dx%d became %dx%d, want %dx%d", c.name, c.width, c.height, w, h, c.wantW, c.wantH)
+		}
+	}
+}
+
+func TestResizeAlphaWeighted(t *testing.T) {
+	// Visible red next to transparent green: the green must not tint the
+	// visible result.
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{R: 255, A: 255})
+	src.SetNRGBA(1, 0, color.NRGBA{G: 255})
+	for _, f := range resampleFilters {
+		got := resize(src, 1, 1, f).NRGBAAt(0, 0)
+		if got.R != 255 || got.G != 0 || got.B != 0 {
+			t.Errorf("%s: got %v, want pure red", f.name, got)
+		}
+		if got.A < 127 || got.A > 128 {
+			t.Errorf("%s: alpha %d, want half", f.name, got.A)
+		}
+	}
+
+	// Fully transparent pixels keep their colour rather than turning black.
+	src.SetNRGBA(0, 0, color.NRGBA{G: 255})
+	if got := resize(src, 1, 1, resampleFilters[0]).NRGBAAt(0, 0); got != (color.NRGBA{G: 255}) {
+		t.Errorf("transparent: got %v, want transparent green", got)
+	}
+}
+
+func TestResizeLinearLight(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			v := uint8(0)
+			if (x+y)%2 == 0 {
+				v = 255
+			}
+			src.SetNRGBA(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	// Half black, half white is 0.5 in linear light, which sRGB encodes
+	// as 188; averaging the encoded values would give 128.
+	box, err := findFilter("box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := resize(src, 4, 4, box)
+	for i := 0; i < len(m.Pix); i += 4 {
+		if got := m.Pix[i]; got < 187 || got > 189 {
+			t.Fatalf("box: pixel %d is %d, want about 188", i/4, got)
+		}
+	}
+	for _, f := range resampleFilters {
+		if got := resize(src, 1, 1, f).Pix[0]; got < 187 || got > 189 {
+			t.Errorf("%s: the average is %d, want about 188", f.name, got)
+		}
+	}
+}
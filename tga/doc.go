@@ -0,0 +1,21 @@
+// Package tga implements a TGA (Truevision TARGA) image encoder and decoder
+// geared towards idTech 3 engines.
+//
+// The decoder supports image types 1, 2, 3, 9, 10 and 11: colour-mapped,
+// true-colour and grayscale, each uncompressed or RLE compressed, with 15,
+// 16, 24 or 32-bit pixels and either origin. Importing the package registers
+// it with image.Decode.
+//
+// The encoder writes any image.Image as 8-bit grayscale, 16-bit ARGB1555,
+// 24-bit BGR or 32-bit BGRA, uncompressed or with size-optimal RLE packets,
+// bottom-left (as idTech 3 expects) or top-left, optionally followed by a
+// TGA 2.0 extension area and footer. Colour is always written as straight
+// (non-premultiplied) alpha.
+//
+// The exported API follows semantic versioning: Version is bumped with every
+// release, and nothing exported is removed or changed incompatibly within a
+// major version.
+package tga
+
+// Version is the version of the package API.
+const Version = "1.0.0"
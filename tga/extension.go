@@ -0,0 +1,99 @@
+package tga
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Sizes and signature of the TGA 2.0 extension area and footer.
+const (
+	ExtensionAreaSize = 495
+	FooterSize        = 26
+	Signature         = "TRUEVISION-XFILE.\x00"
+)
+
+// TGA 2.0 attributes types, recorded in the extension area.
+const (
+	attributesNoAlpha     = 0
+	attributesUsefulAlpha = 3
+)
+
+// Metadata is written to the TGA 2.0 extension area. Text fields are ASCII;
+// other bytes are replaced and overlong values truncated to the field size.
+type Metadata struct {
+	// Author is the author name, up to 40 characters.
+	Author string
+	// Comments holds up to 4 lines of up to 80 characters.
+	Comments []string
+	// Time is the date and time the image was saved.
+	Time time.Time
+	// JobName is the job name or ID, up to 40 characters.
+	JobName string
+	// SoftwareID names the program that created the image, up to 40
+	// characters.
+	SoftwareID string
+	// SoftwareVersion is the program version multiplied by 100, e.g. 213 for
+	// 2.13, and SoftwareLetter an optional version letter such as 'b'.
+	SoftwareVersion uint16
+	SoftwareLetter  byte
+}
+
+// putASCII copies s into the fixed-size, NUL-terminated field dst, replacing
+// non-ASCII bytes and truncating to leave room for the terminator.
+func putASCII(dst []byte, s string) {
+	n := 0
+	for i := 0; i < len(s) && n < len(dst)-1; i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e {
+			c = '?'
+		}
+		dst[n] = c
+		n++
+	}
+}
+
+// writeFooter writes the extension area for meta, assumed to start at
+// offset, followed by the footer that points at it.
+func writeFooter(w io.Writer, offset int64, meta *Metadata, attributesType byte) error {
+	if offset > 0xffffffff {
+		return fmt.Errorf("tga: image too large for a TGA 2.0 footer")
+	}
+
+	var ext [ExtensionAreaSize]byte
+	binary.LittleEndian.PutUint16(ext[0:], ExtensionAreaSize)
+	putASCII(ext[2:43], meta.Author)
+	for i, line := range meta.Comments {
+		if i == 4 {
+			break
+		}
+		putASCII(ext[43+i*81:43+(i+1)*81], line)
+	}
+	if t := meta.Time; !t.IsZero() {
+		binary.LittleEndian.PutUint16(ext[367:], uint16(t.Month()))
+		binary.LittleEndian.PutUint16(ext[369:], uint16(t.Day()))
+		binary.LittleEndian.PutUint16(ext[371:], uint16(t.Year()))
+		binary.LittleEndian.PutUint16(ext[373:], uint16(t.Hour()))
+		binary.LittleEndian.PutUint16(ext[375:], uint16(t.Minute()))
+		binary.LittleEndian.PutUint16(ext[377:], uint16(t.Second()))
+	}
+	putASCII(ext[379:420], meta.JobName)
+	putASCII(ext[426:467], meta.SoftwareID)
+	binary.LittleEndian.PutUint16(ext[467:], meta.SoftwareVersion)
+	ext[469] = ' '
+	if meta.SoftwareLetter != 0 {
+		ext[469] = meta.SoftwareLetter
+	}
+	ext[494] = attributesType
+
+	if _, err := w.Write(ext[:]); err != nil {
+		return err
+	}
+
+	var footer [FooterSize]byte
+	binary.LittleEndian.PutUint32(footer[0:], uint32(offset))
+	copy(footer[8:], Signature)
+	_, err := w.Write(footer[:])
+	return err
+}
@@ -0,0 +1,378 @@
+package tga
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+)
+
+// A FormatError reports that the input is not a valid TGA.
+type FormatError string
+
+func (e FormatError) Error() string { return "tga: invalid format: " + string(e) }
+
+// An UnsupportedError reports that the input uses a valid but unimplemented
+// TGA feature.
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string { return "tga: unsupported feature: " + string(e) }
+
+// maxPixels bounds the image size the decoder allocates for, since a header
+// alone can claim up to 65535x65535 pixels.
+const maxPixels = 1 << 28
+
+// HeaderSize is the size of the fixed TGA header.
+const HeaderSize = 18
+
+// Header is the fixed 18-byte header at the start of every TGA.
+type Header struct {
+	IDLength       uint8
+	ColorMapType   uint8
+	ImageType      uint8
+	ColorMapStart  uint16
+	ColorMapLength uint16
+	ColorMapDepth  uint8
+	XOrigin        uint16
+	YOrigin        uint16
+	Width          uint16
+	Height         uint16
+	PixelDepth     uint8
+	Descriptor     uint8
+}
+
+// AlphaBits returns the number of attribute (alpha) bits per pixel.
+func (h Header) AlphaBits() int { return int(h.Descriptor & 0x0f) }
+
+// TopToBottom reports whether rows are stored from the top down.
+func (h Header) TopToBottom() bool { return h.Descriptor&0x20 != 0 }
+
+// RightToLeft reports whether pixels in a row are stored right to left.
+func (h Header) RightToLeft() bool { return h.Descriptor&0x10 != 0 }
+
+// RLE reports whether the pixel data is run-length encoded.
+func (h Header) RLE() bool { return h.ImageType >= 9 }
+
+// ColorMapped reports whether pixels are indices into a colour map.
+func (h Header) ColorMapped() bool { return h.ImageType == 1 || h.ImageType == 9 }
+
+// Grayscale reports whether pixels are grayscale values.
+func (h Header) Grayscale() bool { return h.ImageType == 3 || h.ImageType == 11 }
+
+// ReadHeader reads and validates a TGA header.
+func ReadHeader(r io.Reader) (Header, error) {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Header{}, FormatError("truncated header")
+		}
+		return Header{}, err
+	}
+	h := Header{
+		IDLength:       b[0],
+		ColorMapType:   b[1],
+		ImageType:      b[2],
+		ColorMapStart:  binary.LittleEndian.Uint16(b[3:]),
+		ColorMapLength: binary.LittleEndian.Uint16(b[5:]),
+		ColorMapDepth:  b[7],
+		XOrigin:        binary.LittleEndian.Uint16(b[8:]),
+		YOrigin:        binary.LittleEndian.Uint16(b[10:]),
+		Width:          binary.LittleEndian.Uint16(b[12:]),
+		Height:         binary.LittleEndian.Uint16(b[14:]),
+		PixelDepth:     b[16],
+		Descriptor:     b[17],
+	}
+	return h, h.validate()
+}
+
+func (h Header) validate() error {
+	switch h.ColorMapType {
+	case 0, 1:
+	default:
+		return FormatError("bad colour map type")
+	}
+	switch h.ImageType {
+	case 1, 9:
+		if h.ColorMapType != 1 || h.ColorMapLength == 0 {
+			return FormatError("colour-mapped image without a colour map")
+		}
+		if h.PixelDepth != 8 && h.PixelDepth != 16 {
+			return UnsupportedError("colour map index depth")
+		}
+	case 2, 10:
+		switch h.PixelDepth {
+		case 15, 16, 24, 32:
+		default:
+			return UnsupportedError("true-colour pixel depth")
+		}
+	case 3, 11:
+		if h.PixelDepth != 8 && h.PixelDepth != 16 {
+			return UnsupportedError("grayscale pixel depth")
+		}
+	case 0:
+		return UnsupportedError("image without image data")
+	default:
+		return UnsupportedError("image type")
+	}
+	if h.ColorMapType == 1 {
+		switch h.ColorMapDepth {
+		case 15, 16, 24, 32:
+		default:
+			return UnsupportedError("colour map entry depth")
+		}
+	}
+	if h.Width == 0 || h.Height == 0 {
+		return FormatError("zero width or height")
+	}
+	return nil
+}
+
+func (h Header) colorModel() color.Model {
+	if h.Grayscale() && h.PixelDepth == 8 {
+		return color.GrayModel
+	}
+	return color.NRGBAModel
+}
+
+// DecodeConfig returns the colour model and dimensions of a TGA image without
+// decoding the entire image.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: h.colorModel(),
+		Width:      int(h.Width),
+		Height:     int(h.Height),
+	}, nil
+}
+
+// Decode reads a TGA image from r. Grayscale images without alpha are
+// returned as *image.Gray, everything else as *image.NRGBA with straight
+// alpha. As in idTech 3, the alpha byte of 32-bit pixels is always used.
+func Decode(r io.Reader) (image.Image, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	width := int(h.Width)
+	height := int(h.Height)
+	if int64(width)*int64(height) > maxPixels {
+		return nil, UnsupportedError("image too large")
+	}
+
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &decoder{r: br, h: h}
+
+	if _, err := br.Discard(int(h.IDLength)); err != nil {
+		return nil, truncated("image ID", err)
+	}
+	if err := d.readColorMap(); err != nil {
+		return nil, err
+	}
+
+	dstBpp := 4
+	if h.colorModel() == color.GrayModel {
+		dstBpp = 1
+	}
+	total := width * height
+	size := total * dstBpp
+
+	// Pixels are decoded in file order into a buffer that only grows as
+	// the data arrives, so a header claiming a huge image costs nothing
+	// until the file backs it up. Rows are put in place afterwards.
+	var pix []byte
+	srcBpp := (int(h.PixelDepth) + 7) / 8
+	px := make([]byte, srcBpp)
+	var c [4]byte
+	for i := 0; i < total; {
+		count := 1
+		repeat := false
+		if h.RLE() {
+			packet, err := br.ReadByte()
+			if err != nil {
+				return nil, truncated("RLE packet", err)
+			}
+			count = int(packet&0x7f) + 1
+			repeat = packet&0x80 != 0
+			if i+count > total {
+				return nil, FormatError("RLE packet overruns image")
+			}
+		}
+		pix = grow(pix, count*dstBpp, size)
+		for k := 0; k < count; k++ {
+			if k == 0 || !repeat {
+				if _, err := io.ReadFull(br, px); err != nil {
+					return nil, truncated("pixel data", err)
+				}
+				if err := d.store(c[:dstBpp], px); err != nil {
+					return nil, err
+				}
+			}
+			pix = append(pix, c[:dstBpp]...)
+		}
+		i += count
+	}
+
+	stride := width * dstBpp
+	if !h.TopToBottom() {
+		row := make([]byte, stride)
+		for y := 0; y < height/2; y++ {
+			top := pix[y*stride : (y+1)*stride]
+			bottom := pix[(height-1-y)*stride : (height-y)*stride]
+			copy(row, top)
+			copy(top, bottom)
+			copy(bottom, row)
+		}
+	}
+	if h.RightToLeft() {
+		for y := 0; y < height; y++ {
+			row := pix[y*stride : (y+1)*stride]
+			for l, r := 0, width-1; l < r; l, r = l+1, r-1 {
+				for k := 0; k < dstBpp; k++ {
+					row[l*dstBpp+k], row[r*dstBpp+k] = row[r*dstBpp+k], row[l*dstBpp+k]
+				}
+			}
+		}
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	if dstBpp == 1 {
+		return &image.Gray{Pix: pix, Stride: stride, Rect: rect}, nil
+	}
+	return &image.NRGBA{Pix: pix, Stride: stride, Rect: rect}, nil
+}
+
+// grow returns b with room for n more bytes, growing it geometrically but
+// never beyond limit bytes in total.
+func grow(b []byte, n, limit int) []byte {
+	if len(b)+n <= cap(b) {
+		return b
+	}
+	c := 2 * cap(b)
+	if c < len(b)+n {
+		c = len(b) + n
+	}
+	if c < 64<<10 {
+		c = 64 << 10
+	}
+	if c > limit {
+		c = limit
+	}
+	nb := make([]byte, len(b), c)
+	copy(nb, b)
+	return nb
+}
+
+type decoder struct {
+	r    *bufio.Reader
+	h    Header
+	cmap []color.NRGBA
+}
+
+func truncated(what string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return FormatError("truncated " + what)
+	}
+	return err
+}
+
+// readColorMap reads the colour map, which is skipped for images that do
+// not use it.
+func (d *decoder) readColorMap() error {
+	h := d.h
+	if h.ColorMapType == 0 {
+		return nil
+	}
+	entryBytes := (int(h.ColorMapDepth) + 7) / 8
+	if !h.ColorMapped() {
+		if _, err := d.r.Discard(int(h.ColorMapLength) * entryBytes); err != nil {
+			return truncated("colour map", err)
+		}
+		return nil
+	}
+	d.cmap = make([]color.NRGBA, h.ColorMapLength)
+	entry := make([]byte, entryBytes)
+	for i := range d.cmap {
+		if _, err := io.ReadFull(d.r, entry); err != nil {
+			return truncated("colour map", err)
+		}
+		d.cmap[i] = decodeColor(entry, h.ColorMapDepth, h.AlphaBits())
+	}
+	return nil
+}
+
+// store decodes the file pixel px into dst, 1 byte for 8-bit grayscale and
+// 4 bytes of NRGBA otherwise.
+func (d *decoder) store(dst, px []byte) error {
+	h := d.h
+	switch {
+	case h.Grayscale() && h.PixelDepth == 8:
+		dst[0] = px[0]
+		return nil
+	case h.Grayscale():
+		dst[0], dst[1], dst[2], dst[3] = px[0], px[0], px[0], px[1]
+		return nil
+	}
+
+	var c color.NRGBA
+	if h.ColorMapped() {
+		index := int(px[0])
+		if h.PixelDepth == 16 {
+			index |= int(px[1]) << 8
+		}
+		index -= int(h.ColorMapStart)
+		if index < 0 || index >= len(d.cmap) {
+			return FormatError("colour map index out of range")
+		}
+		c = d.cmap[index]
+	} else {
+		c = decodeColor(px, h.PixelDepth, h.AlphaBits())
+	}
+	dst[0], dst[1], dst[2], dst[3] = c.R, c.G, c.B, c.A
+	return nil
+}
+
+// decodeColor decodes a little-endian BGR(A) value of the given depth. The
+// top bit of 16-bit values is only treated as alpha when the descriptor
+// declares an alpha bit, since many writers leave it zero.
+func decodeColor(b []byte, depth uint8, alphaBits int) color.NRGBA {
+	switch depth {
+	case 15, 16:
+		v := uint16(b[0]) | uint16(b[1])<<8
+		c := color.NRGBA{
+			R: pixel.Expand5(v >> 10),
+			G: pixel.Expand5(v >> 5),
+			B: pixel.Expand5(v),
+			A: 255,
+		}
+		if depth == 16 && alphaBits > 0 && v&0x8000 == 0 {
+			c.A = 0
+		}
+		return c
+	case 24:
+		return color.NRGBA{R: b[2], G: b[1], B: b[0], A: 255}
+	default:
+		return color.NRGBA{R: b[2], G: b[1], B: b[0], A: b[3]}
+	}
+}
+
+func init() {
+	// TGA has no signature, so match the colour map type and image type
+	// bytes that follow the ID length. Every image type may carry a colour
+	// map, which only the colour-mapped types use.
+	for _, magic := range []string{
+		"?\x00\x02", "?\x00\x03", "?\x00\x0a", "?\x00\x0b",
+		"?\x01\x01", "?\x01\x02", "?\x01\x03",
+		"?\x01\x09", "?\x01\x0a", "?\x01\x0b",
+	} {
+		image.RegisterFormat("tga", magic, Decode, DecodeConfig)
+	}
+}
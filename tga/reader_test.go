@@ -0,0 +1,261 @@
+package tga
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/testimage"
+)
+
+// tgaFile assembles a TGA from a header, image ID, colour map and pixel data.
+func tgaFile(h Header, id, cmap, data []byte) []byte {
+	h.IDLength = uint8(len(id))
+	b := h.bytes()
+	file := append([]byte{}, b[:]...)
+	file = append(file, id...)
+	file = append(file, cmap...)
+	return append(file, data...)
+}
+
+// BGR bytes of testimage's colours.
+var (
+	bgrRed, bgrGreen, bgrBlue, bgrWhite = []byte{0, 0, 255}, []byte{0, 255, 0}, []byte{255, 0, 0}, []byte{255, 255, 255}
+)
+
+// Every case decodes to a 2x2 image.
+var decodeTests = []struct {
+	name string
+	h    Header
+	id   []byte
+	cmap []byte
+	data []byte
+	gray bool
+	// want lists the pixels from the top left, row by row.
+	want []color.NRGBA
+}{
+	{
+		name: "type 2, 24-bit, bottom-left",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 24},
+		data: testimage.Cat(bgrBlue, bgrWhite, bgrRed, bgrGreen),
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2, 24-bit, top-left",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 24, Descriptor: 0x20},
+		data: testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite),
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2, 24-bit, top-right",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 24, Descriptor: 0x30},
+		data: testimage.Cat(bgrGreen, bgrRed, bgrWhite, bgrBlue),
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2, 32-bit, straight alpha",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 32, Descriptor: 0x28},
+		data: []byte{0, 0, 255, 255, 0, 255, 0, 128, 255, 0, 0, 0, 255, 255, 255, 255},
+		want: []color.NRGBA{testimage.Red, {G: 255, A: 128}, {B: 255}, testimage.White},
+	},
+	{
+		name: "type 2, 16-bit with alpha bit",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 16, Descriptor: 0x21},
+		data: []byte{0x00, 0xfc, 0xe0, 0x03, 0x1f, 0x80, 0xff, 0xff},
+		want: []color.NRGBA{testimage.Red, {G: 255}, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2, 16-bit without alpha bits",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 16, Descriptor: 0x20},
+		data: []byte{0x00, 0xfc, 0xe0, 0x03, 0x1f, 0x80, 0xff, 0xff},
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2, 15-bit",
+		h:    Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 15, Descriptor: 0x20},
+		data: []byte{0x00, 0x7c, 0xe0, 0x03, 0x1f, 0x00, 0xff, 0x7f},
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 2 with an image ID and an unused colour map",
+		h: Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 24, Descriptor: 0x20,
+			ColorMapType: 1, ColorMapLength: 2, ColorMapDepth: 24},
+		id:   []byte("abc"),
+		cmap: testimage.Cat(bgrWhite, bgrWhite),
+		data: testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite),
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 3, 8-bit",
+		h:    Header{ImageType: 3, Width: 2, Height: 2, PixelDepth: 8, Descriptor: 0x20},
+		data: []byte{0, 85, 170, 255},
+		gray: true,
+		want: []color.NRGBA{{A: 255}, {85, 85, 85, 255}, {170, 170, 170, 255}, testimage.White},
+	},
+	{
+		name: "type 3, 16-bit with alpha",
+		h:    Header{ImageType: 3, Width: 2, Height: 2, PixelDepth: 16, Descriptor: 0x28},
+		data: []byte{10, 255, 20, 0, 30, 128, 40, 255},
+		want: []color.NRGBA{{10, 10, 10, 255}, {20, 20, 20, 0}, {30, 30, 30, 128}, {40, 40, 40, 255}},
+	},
+	{
+		name: "type 3 with an unused colour map",
+		h: Header{ImageType: 3, Width: 2, Height: 2, PixelDepth: 8, Descriptor: 0x20,
+			ColorMapType: 1, ColorMapLength: 1, ColorMapDepth: 24},
+		cmap: bgrWhite,
+		data: []byte{0, 85, 170, 255},
+		gray: true,
+		want: []color.NRGBA{{A: 255}, {85, 85, 85, 255}, {170, 170, 170, 255}, testimage.White},
+	},
+	{
+		name: "type 1, 24-bit map",
+		h: Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 8, Descriptor: 0x20,
+			ColorMapType: 1, ColorMapLength: 4, ColorMapDepth: 24},
+		cmap: testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite),
+		data: []byte{0, 1, 2, 3},
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 1, map starting at 2",
+		h: Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 8,
+			ColorMapType: 1, ColorMapStart: 2, ColorMapLength: 4, ColorMapDepth: 24},
+		cmap: testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite),
+		data: []byte{4, 5, 2, 3},
+		want: []color.NRGBA{testimage.Red, testimage.Green, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 1, 32-bit map",
+		h: Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 8, Descriptor: 0x28,
+			ColorMapType: 1, ColorMapLength: 2, ColorMapDepth: 32},
+		cmap: []byte{0, 0, 255, 255, 255, 0, 0, 0},
+		data: []byte{0, 1, 1, 0},
+		want: []color.NRGBA{testimage.Red, {B: 255}, {B: 255}, testimage.Red},
+	},
+	{
+		name: "type 1, 16-bit indices and map",
+		h: Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 16, Descriptor: 0x21,
+			ColorMapType: 1, ColorMapLength: 2, ColorMapDepth: 16},
+		cmap: []byte{0x00, 0xfc, 0xe0, 0x03},
+		data: []byte{0, 0, 1, 0, 1, 0, 0, 0},
+		want: []color.NRGBA{testimage.Red, {G: 255}, {G: 255}, testimage.Red},
+	},
+	{
+		name: "type 9, run and raw packets",
+		h: Header{ImageType: 9, Width: 2, Height: 2, PixelDepth: 8, Descriptor: 0x20,
+			ColorMapType: 1, ColorMapLength: 4, ColorMapDepth: 24},
+		cmap: testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite),
+		data: []byte{0x81, 0, 0x01, 2, 3},
+		want: []color.NRGBA{testimage.Red, testimage.Red, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 10, packets per row, bottom-left",
+		h:    Header{ImageType: 10, Width: 2, Height: 2, PixelDepth: 24},
+		data: testimage.Cat([]byte{0x01}, bgrBlue, bgrWhite, []byte{0x81}, bgrRed),
+		want: []color.NRGBA{testimage.Red, testimage.Red, testimage.Blue, testimage.White},
+	},
+	{
+		name: "type 10, run crossing a row",
+		h:    Header{ImageType: 10, Width: 2, Height: 2, PixelDepth: 32, Descriptor: 0x28},
+		data: []byte{0x82, 0, 0, 255, 255, 0x00, 255, 255, 255, 255},
+		want: []color.NRGBA{testimage.Red, testimage.Red, testimage.Red, testimage.White},
+	},
+	{
+		name: "type 11, 8-bit",
+		h:    Header{ImageType: 11, Width: 2, Height: 2, PixelDepth: 8},
+		data: []byte{0x83, 7},
+		gray: true,
+		want: []color.NRGBA{{7, 7, 7, 255}, {7, 7, 7, 255}, {7, 7, 7, 255}, {7, 7, 7, 255}},
+	},
+	{
+		name: "type 11 with an unused colour map",
+		h: Header{ImageType: 11, Width: 2, Height: 2, PixelDepth: 8,
+			ColorMapType: 1, ColorMapLength: 1, ColorMapDepth: 24},
+		cmap: bgrWhite,
+		data: []byte{0x83, 7},
+		gray: true,
+		want: []color.NRGBA{{7, 7, 7, 255}, {7, 7, 7, 255}, {7, 7, 7, 255}, {7, 7, 7, 255}},
+	},
+}
+
+func TestDecode(t *testing.T) {
+	for _, c := range decodeTests {
+		m, err := Decode(bytes.NewReader(tgaFile(c.h, c.id, c.cmap, c.data)))
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if _, ok := m.(*image.Gray); ok != c.gray {
+			t.Errorf("%s: decoded to %T", c.name, m)
+		}
+		testimage.CheckPixels(t, c.name, m, 2, 2, c.want)
+
+		// TGA has no signature; image.Decode must still recognise it.
+		if _, format, err := image.Decode(bytes.NewReader(tgaFile(c.h, c.id, c.cmap, c.data))); format != "tga" || err != nil {
+			t.Errorf("%s: image.Decode gave format %q, error %v", c.name, format, err)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	rgb := Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 24}
+	rle := Header{ImageType: 10, Width: 2, Height: 2, PixelDepth: 24}
+	mapped := Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 8,
+		ColorMapType: 1, ColorMapStart: 2, ColorMapLength: 2, ColorMapDepth: 24}
+	cmap := testimage.Cat(bgrRed, bgrGreen)
+	pixels := testimage.Cat(bgrRed, bgrGreen, bgrBlue, bgrWhite)
+	full := tgaFile(rgb, []byte("id"), nil, pixels)
+
+	cases := []struct {
+		name string
+		file []byte
+		want string
+	}{
+		{"empty", nil, "truncated header"},
+		{"truncated header", full[:10], "truncated header"},
+		{"truncated image ID", full[:HeaderSize+1], "truncated image ID"},
+		{"truncated colour map", tgaFile(mapped, nil, cmap[:4], nil), "truncated colour map"},
+		{"truncated pixel data", full[:len(full)-1], "truncated pixel data"},
+		{"missing RLE packet", tgaFile(rle, nil, nil, testimage.Cat([]byte{0x81}, bgrRed)), "truncated RLE packet"},
+		{"truncated run", tgaFile(rle, nil, nil, []byte{0x83, 0}), "truncated pixel data"},
+		{"truncated raw packet", tgaFile(rle, nil, nil, testimage.Cat([]byte{0x03}, bgrRed)), "truncated pixel data"},
+		{"RLE overrun", tgaFile(rle, nil, nil, testimage.Cat([]byte{0x84}, bgrRed)), "overruns"},
+		{"RLE overrun after a packet", tgaFile(rle, nil, nil, testimage.Cat([]byte{0x80}, bgrRed, []byte{0x83}, bgrRed)), "overruns"},
+		{"index past the map", tgaFile(mapped, nil, cmap, []byte{2, 3, 4, 2}), "index out of range"},
+		{"index before the map", tgaFile(mapped, nil, cmap, []byte{2, 3, 1, 2}), "index out of range"},
+		{"image type 0", tgaFile(Header{Width: 2, Height: 2, PixelDepth: 24}, nil, nil, nil), "without image data"},
+		{"image type 4", tgaFile(Header{ImageType: 4, Width: 2, Height: 2, PixelDepth: 24}, nil, nil, nil), "image type"},
+		{"zero width", tgaFile(Header{ImageType: 2, Height: 2, PixelDepth: 24}, nil, nil, nil), "zero width"},
+		{"type 1 without a map", tgaFile(Header{ImageType: 1, Width: 2, Height: 2, PixelDepth: 8}, nil, nil, nil), "without a colour map"},
+		{"bad pixel depth", tgaFile(Header{ImageType: 2, Width: 2, Height: 2, PixelDepth: 8}, nil, nil, nil), "pixel depth"},
+	}
+	for _, c := range cases {
+		_, err := Decode(bytes.NewReader(c.file))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got error %v, want one mentioning %q", c.name, err, c.want)
+		}
+	}
+}
+
+// A header claiming a huge image must not cost memory the file does not
+// back up with pixel data.
+func TestDecodeHugeHeaderWithoutData(t *testing.T) {
+	for _, h := range []Header{
+		{ImageType: 2, Width: 16384, Height: 16384, PixelDepth: 32},
+		{ImageType: 10, Width: 16384, Height: 16384, PixelDepth: 32},
+	} {
+		file := tgaFile(h, nil, nil, []byte{0, 0, 0, 0})
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := Decode(bytes.NewReader(file))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("type %d: decoded a truncated file", h.ImageType)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("type %d: allocated %d bytes for a %d-byte file", h.ImageType, allocated, len(file))
+		}
+	}
+}
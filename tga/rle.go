@@ -0,0 +1,173 @@
+package tga
+
+import (
+	"io"
+)
+
+// rleSegmentPixels is the minimum span planned at once when packets may cross
+// scanlines. Splitting the image into spans costs at most one packet header
+// plus one pixel per boundary over the true optimum, which is negligible at
+// this size, and keeps the planner's tables small.
+const rleSegmentPixels = 1 << 16
+
+func pixelsEqual(pixels []byte, a, b, bpp int) bool {
+	ai := a * bpp
+	bi := b * bpp
+	for i := 0; i < bpp; i++ {
+		if pixels[ai+i] != pixels[bi+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rleEncoder packs pixels into the fewest bytes possible using TGA run and
+// raw packets of up to 128 pixels each.
+//
+// cost[i] is the smallest encoding of the first i pixels of a span. A raw
+// packet ending at i costs 1 + (i-j)*bpp on top of cost[j] for any j within
+// 128 pixels, so the best j is the minimum of cost[j] - j*bpp over a sliding
+// window. A run packet ending at i costs 1 + bpp on top of cost[j] where
+// pixels j..i-1 are equal; cost never decreases with i, so the earliest
+// such j is always best. Both are O(1) amortised per pixel.
+type rleEncoder struct {
+	bpp    int
+	cost   []int
+	from   []int32
+	isRun  []bool
+	window []int32
+	ends   []int32
+}
+
+func newRLEEncoder(bpp int) *rleEncoder {
+	return &rleEncoder{bpp: bpp}
+}
+
+// plan fills the encoder's tables for span and returns its encoded size.
+func (e *rleEncoder) plan(span []byte) int {
+	bpp := e.bpp
+	n := len(span) / bpp
+	if cap(e.cost) < n+1 {
+		e.cost = make([]int, n+1)
+		e.from = make([]int32, n+1)
+		e.isRun = make([]bool, n+1)
+	}
+	e.cost = e.cost[:n+1]
+	e.from = e.from[:n+1]
+	e.isRun = e.isRun[:n+1]
+	e.window = e.window[:0]
+	head := 0
+
+	e.cost[0] = 0
+	runLen := 0
+	for i := 1; i <= n; i++ {
+		j := i - 1
+		// Keep window sorted by cost[k] - k*bpp, holding candidates in
+		// [i-128, i-1] for the start of a raw packet ending at i.
+		key := e.cost[j] - j*bpp
+		for len(e.window) > head {
+			last := int(e.window[len(e.window)-1])
+			if e.cost[last]-last*bpp < key {
+				break
+			}
+			e.window = e.window[:len(e.window)-1]
+		}
+		e.window = append(e.window, int32(j))
+		if int(e.window[head]) < i-128 {
+			head++
+		}
+
+		start := int(e.window[head])
+		e.cost[i] = e.cost[start] + 1 + (i-start)*bpp
+		e.from[i] = int32(start)
+		e.isRun[i] = false
+
+		if j > 0 && pixelsEqual(span, j, j-1, bpp) {
+			runLen++
+		} else {
+			runLen = 1
+		}
+		if runLen >= 2 {
+			length := runLen
+			if length > 128 {
+				length = 128
+			}
+			if c := e.cost[i-length] + 1 + bpp; c < e.cost[i] {
+				e.cost[i] = c
+				e.from[i] = int32(i - length)
+				e.isRun[i] = true
+			}
+		}
+	}
+	return e.cost[n]
+}
+
+// encode writes the packets found by the last call to plan for span.
+func (e *rleEncoder) encode(w byteWriter, span []byte) error {
+	bpp := e.bpp
+	n := len(span) / bpp
+
+	// Walk the plan backwards, then emit packets front to back.
+	e.ends = e.ends[:0]
+	for i := n; i > 0; i = int(e.from[i]) {
+		e.ends = append(e.ends, int32(i))
+	}
+	for k := len(e.ends) - 1; k >= 0; k-- {
+		end := int(e.ends[k])
+		start := int(e.from[end])
+		length := end - start
+		if e.isRun[end] {
+			if err := w.WriteByte(byte(0x80 | (length - 1))); err != nil {
+				return err
+			}
+			if _, err := w.Write(span[start*bpp : start*bpp+bpp]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := w.WriteByte(byte(length - 1)); err != nil {
+			return err
+		}
+		if _, err := w.Write(span[start*bpp : end*bpp]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// byteWriter is the writer RLE packets are written to.
+type byteWriter interface {
+	io.Writer
+	io.ByteWriter
+}
+
+// rleRowsPerSpan returns how many rows are planned at once: one when packets
+// must not cross scanlines, otherwise enough for at least rleSegmentPixels.
+func rleRowsPerSpan(width int, scanline bool) int {
+	if scanline {
+		return 1
+	}
+	return (rleSegmentPixels + width - 1) / width
+}
+
+// rleSize returns the size of the RLE-encoded pixel data.
+func rleSize(p *pixelPacker, scanline bool) (int, error) {
+	e := newRLEEncoder(p.bpp)
+	size := 0
+	err := p.spans(rleRowsPerSpan(p.width, scanline), func(span []byte) error {
+		size += e.plan(span)
+		return nil
+	})
+	return size, err
+}
+
+// writeRLEPixels writes size-optimal RLE packets for the pixels of p. When
+// scanline is set no packet crosses a row boundary, as the TGA specification
+// requires; idTech 3 loaders accept either form.
+func writeRLEPixels(w byteWriter, p *pixelPacker, scanline bool) error {
+	e := newRLEEncoder(p.bpp)
+	return p.spans(rleRowsPerSpan(p.width, scanline), func(span []byte) error {
+		e.plan(span)
+		return e.encode(w, span)
+	})
+}
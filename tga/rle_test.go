@@ -0,0 +1,155 @@
+package tga
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+)
+
+// bruteForceRLESize returns the smallest RLE encoding of pixels by trying
+// every packet length at every position.
+func bruteForceRLESize(pixels []byte, bpp int) int {
+	n := len(pixels) / bpp
+	best := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = -1
+		run := true
+		for length := 1; length <= 128 && length <= i; length++ {
+			start := i - length
+			if c := best[start] + 1 + length*bpp; best[i] < 0 || c < best[i] {
+				best[i] = c
+			}
+			// Pixels start..i-1 are equal if start+1..i-1 are and the
+			// first two match.
+			if length > 1 {
+				run = run && pixelsEqual(pixels, start, start+1, bpp)
+			}
+			if c := best[start] + 1 + bpp; run && c < best[i] {
+				best[i] = c
+			}
+		}
+	}
+	return best[n]
+}
+
+// decodeRLE expands RLE packets back into pixels.
+func decodeRLE(t *testing.T, data []byte, bpp int) []byte {
+	t.Helper()
+	var out []byte
+	for len(data) > 0 {
+		header := data[0]
+		length := int(header&0x7f) + 1
+		data = data[1:]
+		if header&0x80 != 0 {
+			if len(data) < bpp {
+				t.Fatal("truncated run packet")
+			}
+			for k := 0; k < length; k++ {
+				out = append(out, data[:bpp]...)
+			}
+			data = data[bpp:]
+			continue
+		}
+		if len(data) < length*bpp {
+			t.Fatal("truncated raw packet")
+		}
+		out = append(out, data[:length*bpp]...)
+		data = data[length*bpp:]
+	}
+	return out
+}
+
+func TestRLEPlanIsOptimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 3000; iter++ {
+		bpp := []int{1, 2, 3, 4}[rng.Intn(4)]
+		n := 1 + rng.Intn(400)
+		// Few distinct values and long stretches of repeats, so that runs
+		// of every length, including over 128, are common.
+		colors := 1 + rng.Intn(4)
+		pixels := make([]byte, 0, n*bpp)
+		for len(pixels) < n*bpp {
+			c := byte(rng.Intn(colors))
+			repeat := 1
+			if rng.Intn(3) == 0 {
+				repeat = 1 + rng.Intn(200)
+			}
+			for k := 0; k < repeat && len(pixels) < n*bpp; k++ {
+				for b := 0; b < bpp; b++ {
+					pixels = append(pixels, c)
+				}
+			}
+		}
+
+		e := newRLEEncoder(bpp)
+		got := e.plan(pixels)
+		if want := bruteForceRLESize(pixels, bpp); got != want {
+			t.Fatalf("case %d (bpp %d, %d pixels): planned %d bytes, optimum is %d", iter, bpp, n, got, want)
+		}
+		var buf bytes.Buffer
+		if err := e.encode(&buf, pixels); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != got {
+			t.Fatalf("case %d: encoded %d bytes, planned %d", iter, buf.Len(), got)
+		}
+		if !bytes.Equal(decodeRLE(t, buf.Bytes(), bpp), pixels) {
+			t.Fatalf("case %d: encoded packets do not decode to the input", iter)
+		}
+	}
+}
+
+func TestCompressionAutoFallsBack(t *testing.T) {
+	noise := func(m image.Image, pix []byte) image.Image {
+		rng := rand.New(rand.NewSource(2))
+		rng.Read(pix)
+		return m
+	}
+	flat := func(m image.Image, pix []byte) image.Image {
+		for i := range pix {
+			pix[i] = byte(0x40 * (i%4 + 1))
+		}
+		return m
+	}
+	rect := image.Rect(0, 0, 64, 64)
+	newRGBA := func() (image.Image, []byte) {
+		m := image.NewNRGBA(rect)
+		return m, m.Pix
+	}
+	newGray := func() (image.Image, []byte) {
+		m := image.NewGray(rect)
+		return m, m.Pix
+	}
+
+	cases := []struct {
+		name      string
+		m         image.Image
+		o         Options
+		imageType byte
+	}{
+		{"true-colour noise", noise(newRGBA()), Options{}, 2},
+		{"true-colour flat", flat(newRGBA()), Options{}, 10},
+		{"grayscale noise", noise(newGray()), Options{Depth: 8}, 3},
+		{"grayscale flat", flat(newGray()), Options{}, 3},
+		{"grayscale flat, RLE forced", flat(newGray()), Options{Compression: CompressionRLE}, 11},
+		{"true-colour noise, RLE forced", noise(newRGBA()), Options{Compression: CompressionRLE}, 10},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		stats, err := EncodeWithStats(&buf, c.m, &c.o)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		h, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if h.ImageType != c.imageType {
+			t.Errorf("%s: wrote image type %d, want %d", c.name, h.ImageType, c.imageType)
+		}
+		if h.RLE() && c.o.Compression == CompressionAuto && stats.PixelBytes >= stats.RawPixelBytes {
+			t.Errorf("%s: RLE written although it is not smaller (%d >= %d bytes)", c.name, stats.PixelBytes, stats.RawPixelBytes)
+		}
+	}
+}
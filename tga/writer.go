@@ -0,0 +1,271 @@
+package tga
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+)
+
+// Compression selects how pixel data is stored.
+type Compression int
+
+const (
+	// CompressionAuto writes RLE colour data (type 10) unless it would be
+	// no smaller than uncompressed data (type 2). Grayscale is always written
+	// uncompressed (type 3), since vanilla idTech 3 loaders reject RLE
+	// grayscale.
+	CompressionAuto Compression = iota
+	// CompressionRLE always writes RLE data (type 10, or 11 for grayscale).
+	CompressionRLE
+	// CompressionNone writes uncompressed data (type 2, or 3 for grayscale).
+	CompressionNone
+)
+
+// Options control how an image is encoded. The zero value writes
+// bottom-left TGAs at the smallest lossless depth, compressed as
+// CompressionAuto decides, which vanilla idTech 3 loaders accept.
+type Options struct {
+	Compression Compression
+	// Depth is the pixel depth: 8 (grayscale luma), 16 (ARGB1555, alpha bit
+	// set from alpha >= 128), 24 (BGR) or 32 (BGRA). Zero picks the
+	// smallest depth that stores the image without loss: 8 for opaque gray
+	// images, 24 for other opaque images and 32 otherwise.
+	Depth int
+	// TopLeft stores rows top to bottom and sets the origin bit instead of
+	// the bottom-left origin idTech 3 expects.
+	TopLeft bool
+	// ScanlineRLE keeps every RLE packet within a single row, as the TGA
+	// specification requires; idTech 3 loaders accept either form.
+	ScanlineRLE bool
+	// Metadata, if non-nil, is written to a TGA 2.0 extension area followed
+	// by a TGA 2.0 footer.
+	Metadata *Metadata
+}
+
+// Stats describes an encoded image.
+type Stats struct {
+	// Header is the header as written.
+	Header Header
+	// PixelBytes is the size of the pixel data as written and RawPixelBytes
+	// its size without compression.
+	PixelBytes    int
+	RawPixelBytes int
+}
+
+// Encode writes m to w as a TGA. A nil o uses the zero Options.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	_, err := EncodeWithStats(w, m, o)
+	return err
+}
+
+// EncodeWithStats is like Encode and also reports what was written.
+func EncodeWithStats(w io.Writer, m image.Image, o *Options) (Stats, error) {
+	if o == nil {
+		o = &Options{}
+	}
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 || width > 65535 || height > 65535 {
+		return Stats{}, fmt.Errorf("tga: invalid image size %dx%d (1 to 65535 pixels per side)", width, height)
+	}
+
+	depth := o.Depth
+	if depth == 0 {
+		depth = pixel.LosslessDepth(m)
+	}
+	var imageType byte
+	switch depth {
+	case 8:
+		imageType = 11
+	case 16, 24, 32:
+		imageType = 10
+	default:
+		return Stats{}, fmt.Errorf("tga: unsupported depth %d", depth)
+	}
+	bpp := depth / 8
+
+	p := newPixelPacker(m, bpp, o.TopLeft)
+
+	raw := width * height * bpp
+	stats := Stats{PixelBytes: raw, RawPixelBytes: raw}
+	rle := o.Compression == CompressionRLE || (o.Compression == CompressionAuto && depth != 8)
+	if rle && o.Compression == CompressionAuto {
+		// The header names the image type, so the RLE size has to be known
+		// before anything is written; plan it in a first pass over m.
+		size, err := rleSize(p, o.ScanlineRLE)
+		if err != nil {
+			return Stats{}, err
+		}
+		if size >= raw {
+			rle = false
+		}
+	}
+	if !rle {
+		imageType -= 8
+	}
+
+	var alphaBits byte
+	switch depth {
+	case 16:
+		alphaBits = 1
+	case 32:
+		alphaBits = 8
+	}
+	descriptor := alphaBits
+	if o.TopLeft {
+		descriptor |= 0x20
+	}
+	stats.Header = Header{
+		ImageType:  imageType,
+		Width:      uint16(width),
+		Height:     uint16(height),
+		PixelDepth: uint8(depth),
+		Descriptor: descriptor,
+	}
+
+	writer := bufio.NewWriter(w)
+	header := stats.Header.bytes()
+	if _, err := writer.Write(header[:]); err != nil {
+		return Stats{}, err
+	}
+	if rle {
+		cw := &countingWriter{w: writer}
+		if err := writeRLEPixels(cw, p, o.ScanlineRLE); err != nil {
+			return Stats{}, err
+		}
+		stats.PixelBytes = cw.n
+	} else if err := p.spans(1, func(span []byte) error {
+		_, err := writer.Write(span)
+		return err
+	}); err != nil {
+		return Stats{}, err
+	}
+
+	if o.Metadata != nil {
+		attributesType := byte(attributesNoAlpha)
+		if alphaBits > 0 {
+			attributesType = attributesUsefulAlpha
+		}
+		offset := int64(HeaderSize + stats.PixelBytes)
+		if err := writeFooter(writer, offset, o.Metadata, attributesType); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	return stats, writer.Flush()
+}
+
+// bytes returns the header in its on-disk form.
+func (h Header) bytes() [HeaderSize]byte {
+	var b [HeaderSize]byte
+	b[0] = h.IDLength
+	b[1] = h.ColorMapType
+	b[2] = h.ImageType
+	binary.LittleEndian.PutUint16(b[3:], h.ColorMapStart)
+	binary.LittleEndian.PutUint16(b[5:], h.ColorMapLength)
+	b[7] = h.ColorMapDepth
+	binary.LittleEndian.PutUint16(b[8:], h.XOrigin)
+	binary.LittleEndian.PutUint16(b[10:], h.YOrigin)
+	binary.LittleEndian.PutUint16(b[12:], h.Width)
+	binary.LittleEndian.PutUint16(b[14:], h.Height)
+	b[16] = h.PixelDepth
+	b[17] = h.Descriptor
+	return b
+}
+
+// pixelPacker produces the pixel data of m in file order, a few rows at a
+// time, so that encoding never holds more than the source image and one
+// span of packed rows.
+type pixelPacker struct {
+	c       *pixel.Rows
+	bpp     int
+	width   int
+	height  int
+	topLeft bool
+	row     []byte
+	buf     []byte
+}
+
+func newPixelPacker(m image.Image, bpp int, topLeft bool) *pixelPacker {
+	b := m.Bounds()
+	return &pixelPacker{
+		c:       pixel.NewRows(m),
+		bpp:     bpp,
+		width:   b.Dx(),
+		height:  b.Dy(),
+		topLeft: topLeft,
+		row:     make([]byte, b.Dx()*4),
+	}
+}
+
+// spans packs the image rows at a time, flipped into bottom-left row order
+// unless topLeft is set, and calls fn with each span. The span is only
+// valid until fn returns.
+func (p *pixelPacker) spans(rows int, fn func(span []byte) error) error {
+	rowBytes := p.width * p.bpp
+	if cap(p.buf) < rows*rowBytes {
+		p.buf = make([]byte, rows*rowBytes)
+	}
+	for y := 0; y < p.height; y += rows {
+		n := rows
+		if y+n > p.height {
+			n = p.height - y
+		}
+		span := p.buf[:n*rowBytes]
+		for k := 0; k < n; k++ {
+			srcY := p.height - 1 - (y + k)
+			if p.topLeft {
+				srcY = y + k
+			}
+			p.c.Row(p.row, srcY)
+			packRow(span[k*rowBytes:(k+1)*rowBytes], p.row, p.bpp)
+		}
+		if err := fn(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w *bufio.Writer
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += n
+	return n, err
+}
+
+func (c *countingWriter) WriteByte(b byte) error {
+	if err := c.w.WriteByte(b); err != nil {
+		return err
+	}
+	c.n++
+	return nil
+}
+
+// packRow packs a row of straight RGBA into dst at bpp bytes per pixel.
+func packRow(dst, row []byte, bpp int) {
+	for x := 0; x < len(row)/4; x++ {
+		r, g, b, a := row[x*4], row[x*4+1], row[x*4+2], row[x*4+3]
+		d := dst[x*bpp:]
+		switch bpp {
+		case 1:
+			d[0] = pixel.Luma(r, g, b)
+		case 2:
+			v := pixel.PackARGB1555(r, g, b, a)
+			d[0], d[1] = byte(v), byte(v>>8)
+		case 3:
+			d[0], d[1], d[2] = b, g, r
+		case 4:
+			d[0], d[1], d[2], d[3] = b, g, r, a
+		}
+	}
+}
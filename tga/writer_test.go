@@ -0,0 +1,155 @@
+package tga
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"runtime"
+	"testing"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	// Runs longer than a packet, single pixels and partial alpha, 130 wide
+	// so that rows do not end on a packet boundary.
+	src := image.NewNRGBA(image.Rect(0, 0, 130, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 130; x++ {
+			c := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+			if x%7 == 0 || y == 1 {
+				c = color.NRGBA{R: uint8(x * 3), G: uint8(y * 90), B: uint8(x ^ y), A: uint8(x * 5)}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+
+	for _, depth := range []int{8, 16, 24, 32} {
+		for _, compression := range []Compression{CompressionAuto, CompressionRLE, CompressionNone} {
+			for _, topLeft := range []bool{false, true} {
+				for _, scanlineRLE := range []bool{false, true} {
+					o := Options{Compression: compression, Depth: depth, TopLeft: topLeft, ScanlineRLE: scanlineRLE}
+					var buf bytes.Buffer
+					if err := Encode(&buf, src, &o); err != nil {
+						t.Errorf("%+v: %v", o, err)
+						continue
+					}
+					h, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+					if err != nil {
+						t.Errorf("%+v: %v", o, err)
+						continue
+					}
+					if int(h.PixelDepth) != depth || h.TopToBottom() != topLeft || compression != CompressionAuto && h.RLE() != (compression == CompressionRLE) {
+						t.Errorf("%+v: wrote header %+v", o, h)
+					}
+					m, err := Decode(&buf)
+					if err != nil {
+						t.Errorf("%+v: %v", o, err)
+						continue
+					}
+					if m.Bounds() != src.Bounds() {
+						t.Errorf("%+v: decoded bounds %v", o, m.Bounds())
+						continue
+					}
+				pixels:
+					for y := 0; y < 3; y++ {
+						for x := 0; x < 130; x++ {
+							want := pixel.EncodedColor(src.NRGBAAt(x, y), depth)
+							if got := color.NRGBAModel.Convert(m.At(x, y)); got != want {
+								t.Errorf("%+v: pixel (%d, %d) is %v, want %v", o, x, y, got, want)
+								break pixels
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// benchmarkImage returns a size x size image of the given type that mixes
+// flat areas, which RLE compresses, with noise, which it cannot.
+func benchmarkImage(size int, opaque bool) image.Image {
+	rect := image.Rect(0, 0, size, size)
+	var pix []byte
+	var m image.Image
+	if opaque {
+		rgba := image.NewRGBA(rect)
+		pix, m = rgba.Pix, rgba
+	} else {
+		nrgba := image.NewNRGBA(rect)
+		pix, m = nrgba.Pix, nrgba
+	}
+	seed := uint32(1)
+	for i := 0; i < len(pix); i += 4 {
+		x := (i / 4) % size
+		if x < size/2 {
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = 40, 80, 120, 255
+			continue
+		}
+		seed = seed*1664525 + 1013904223
+		pix[i], pix[i+1], pix[i+2] = byte(seed>>8), byte(seed>>16), byte(seed>>24)
+		pix[i+3] = 255
+		if !opaque {
+			pix[i+3] = byte(seed)
+		}
+	}
+	return m
+}
+
+// TestEncodeMemory checks that encoding works a few rows at a time: it must
+// allocate far less than a packed copy of the whole image would take.
+func TestEncodeMemory(t *testing.T) {
+	const size = 3072
+	cases := []struct {
+		name   string
+		opaque bool
+		o      Options
+	}{
+		{"RGBA/auto", true, Options{}},
+		{"NRGBA/auto", false, Options{}},
+		{"NRGBA/rle", false, Options{Compression: CompressionRLE}},
+		{"NRGBA/none", false, Options{Compression: CompressionNone}},
+		{"NRGBA/16-bit", false, Options{Depth: 16}},
+	}
+	for _, c := range cases {
+		m := benchmarkImage(size, c.opaque)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		stats, err := EncodeWithStats(io.Discard, m, &c.o)
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(stats.RawPixelBytes/8) {
+			t.Errorf("%s: allocated %d bytes for %d bytes of packed pixels", c.name, allocated, stats.RawPixelBytes)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	cases := []struct {
+		name   string
+		opaque bool
+		o      Options
+	}{
+		{"RGBA/auto", true, Options{}},
+		{"RGBA/none", true, Options{Compression: CompressionNone}},
+		{"NRGBA/auto", false, Options{}},
+		{"NRGBA/rle", false, Options{Compression: CompressionRLE}},
+		{"NRGBA/none", false, Options{Compression: CompressionNone}},
+	}
+	for _, c := range cases {
+		m := benchmarkImage(2048, c.opaque)
+		b.Run(c.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(2048 * 2048 * 4)
+			for i := 0; i < b.N; i++ {
+				if err := Encode(io.Discard, m, &c.o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+// toPNGCommand is the subcommand that converts TGAs back to PNGs.
+const toPNGCommand = "to-png"
+
+// zipMagic starts every zip archive, and so every pk3, that has entries.
+const zipMagic = "PK\x03\x04"
+
+// pngConverter converts TGAs to PNGs and reports on each one.
+type pngConverter struct {
+	policy outputPolicy
+	quiet  bool
+	// failed is set once any conversion has failed.
+	failed bool
+	// written maps each output path written so far to the input it was
+	// converted from, so that two inputs whose names differ only in the
+	// case of the extension, such as a.tga and a.TGA, do not silently
+	// overwrite each other.
+	written map[string]string
+}
+
+// convert decodes the TGA read from r and writes it to outputPath as a PNG.
+// Errors are reported rather than returned so that a batch carries on past
+// a broken file.
+func (c *pngConverter) convert(r io.Reader, inputName, outputPath string) {
+	if err := c.write(r, inputName, outputPath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		c.failed = true
+	}
+}
+
+func (c *pngConverter) write(r io.Reader, inputName, outputPath string) error {
+	key := filepath.Clean(outputPath)
+	if previous, ok := c.written[key]; ok && outputPath != stdioName {
+		return fmt.Errorf("refusing to convert %s: %s was already written from %s", inputName, outputPath, previous)
+	}
+	img, err := tga.Decode(r)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %v", inputName, err)
+	}
+
+	outputName := displayName(outputPath, "stdout")
+	if outputPath == stdioName {
+		if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("refusing to write a PNG to a terminal; redirect standard output")
+		}
+		if err := png.Encode(os.Stdout, img); err != nil {
+			return fmt.Errorf("failed to write PNG to standard output: %v", err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %v", err)
+		}
+		err := writeFileAtomic(outputPath, c.policy, func(w io.Writer) error {
+			return png.Encode(w, img)
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if c.written == nil {
+			c.written = map[string]string{}
+		}
+		c.written[key] = inputName
+	}
+
+	if !c.quiet {
+		// Only image data may reach standard output.
+		reportTo := os.Stdout
+		if outputPath == stdioName {
+			reportTo = os.Stderr
+		}
+		b := img.Bounds()
+		fmt.Fprintf(reportTo, "%s: %dx%d %s PNG from %s\n", outputName, b.Dx(), b.Dy(), pngColorType(img), inputName)
+	}
+	return nil
+}
+
+// pngColorType names the PNG colour type image/png encodes img as.
+func pngColorType(img image.Image) string {
+	switch m := img.(type) {
+	case *image.Gray:
+		return "grayscale"
+	case *image.NRGBA:
+		if m.Opaque() {
+			return "RGB"
+		}
+	}
+	return "RGBA"
+}
+
+// isTGAName reports whether name has a .tga extension in any case.
+func isTGAName(name string) bool {
+	return strings.EqualFold(filepath.Ext(name), ".tga")
+}
+
+// pngPath replaces the extension of the TGA path p with .png.
+func pngPath(p string) string {
+	return strings.TrimSuffix(p, filepath.Ext(p)) + ".png"
+}
+
+// convertFile converts a single TGA file.
+func (c *pngConverter) convertFile(inputPath, outputPath string) {
+	input, err := openInput(inputPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		c.failed = true
+		return
+	}
+	defer input.Close()
+	c.convert(input, displayName(inputPath, "stdin"), outputPath)
+}
+
+// convertDir converts every TGA below inputDir, recreating the directory
+// tree under outputDir.
+func (c *pngConverter) convertDir(inputDir, outputDir string) error {
+	return filepath.WalkDir(inputDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to read input directory: %v", err)
+		}
+		if !d.Type().IsRegular() || !isTGAName(p) {
+			return nil
+		}
+		rel, err := filepath.Rel(inputDir, p)
+		if err != nil {
+			return err
+		}
+		c.convertFile(p, filepath.Join(outputDir, pngPath(rel)))
+		return nil
+	})
+}
+
+// archivePath returns where a pk3 entry is written below the output
+// directory, or false if its name is absolute, names a drive or climbs out
+// of it. Some tools store Windows separators, which are treated as slashes,
+// and names are checked the same way on every platform.
+func archivePath(name string) (string, bool) {
+	p := filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if strings.Contains(name, ":") || !filepath.IsLocal(p) {
+		return "", false
+	}
+	return p, true
+}
+
+// convertArchive converts every TGA in the pk3 at pk3Path, recreating
+// its directory tree under outputDir.
+func (c *pngConverter) convertArchive(pk3Path, outputDir string) error {
+	zr, err := zip.OpenReader(pk3Path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %s: %v", pk3Path, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !isTGAName(f.Name) {
+			continue
+		}
+		inputName := pk3Path + ":" + f.Name
+		rel, ok := archivePath(f.Name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "refusing to extract %s: the path leaves the output directory\n", inputName)
+			c.failed = true
+			continue
+		}
+		entry, err := f.Open()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", inputName, err)
+			c.failed = true
+			continue
+		}
+		c.convert(entry, inputName, filepath.Join(outputDir, pngPath(rel)))
+		entry.Close()
+	}
+	return nil
+}
+
+// isArchive reports whether the file at path is a zip archive such as a pk3.
+func isArchive(path string) (bool, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to open input: %s", path)
+	}
+	defer fp.Close()
+	b := make([]byte, len(zipMagic))
+	if _, err := io.ReadFull(fp, b); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(b, []byte(zipMagic)), nil
+}
+
+func printToPNGUsage(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s %s [options] <input.tga|dir|file.pk3|-> [output.png|dir|-]\n", os.Args[0], toPNGCommand)
+	fmt.Fprintln(w, "Convert TGAs, a directory of them or the TGAs in a pk3 to PNGs with straight alpha.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Options:")
+	flags.SetOutput(w)
+	flags.PrintDefaults()
+}
+
+func exitWithToPNGUsageError(msg string) {
+	if msg != "" {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s %s [options] <input.tga|dir|file.pk3|-> [output.png|dir|-]\n", os.Args[0], toPNGCommand)
+	fmt.Fprintf(os.Stderr, "Try '%s %s --help' for more information.\n", os.Args[0], toPNGCommand)
+	os.Exit(1)
+}
+
+// runToPNG runs the to-png subcommand with the arguments following it.
+func runToPNG(arguments []string) {
+	flags := flag.NewFlagSet(os.Args[0]+" "+toPNGCommand, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var (
+		flagHelp bool
+		c        pngConverter
+	)
+	flags.BoolVar(&flagHelp, "h", false, "Show this help and exit")
+	flags.BoolVar(&flagHelp, "help", false, "Show this help and exit (same as -h)")
+	flags.BoolVar(&c.quiet, "q", false, "Don't report the written PNGs")
+	flags.BoolVar(&c.quiet, "quiet", false, "Don't report the written PNGs (same as -q)")
+	flags.BoolVar(&c.policy.noClobber, "no-clobber", false, "Fail instead of replacing an existing output file")
+	flags.BoolVar(&c.policy.force, "force", false, "Also replace write-protected output files")
+	flags.BoolVar(&c.policy.backup, "backup", false, "Keep an existing output file as <output>~")
+
+	if err := flags.Parse(arguments); err != nil {
+		exitWithToPNGUsageError(err.Error())
+	}
+	if flagHelp {
+		printToPNGUsage(os.Stdout, flags)
+		os.Exit(0)
+	}
+	if err := c.policy.validate(); err != nil {
+		exitWithToPNGUsageError(err.Error())
+	}
+	args := flags.Args()
+	if len(args) != 1 && len(args) != 2 {
+		exitWithToPNGUsageError("")
+	}
+	inputPath := args[0]
+	outputPath := ""
+	if len(args) == 2 {
+		outputPath = args[1]
+	}
+	if outputPath == stdioName || (outputPath == "" && inputPath == stdioName) {
+		if err := c.policy.validateStdout(); err != nil {
+			exitWithToPNGUsageError(err.Error())
+		}
+	}
+
+	var err error
+	info, statErr := os.Stat(inputPath)
+	switch {
+	case inputPath == stdioName:
+		if outputPath == "" {
+			outputPath = stdioName
+		}
+		c.convertFile(inputPath, outputPath)
+	case statErr != nil:
+		err = fmt.Errorf("failed to open input: %s", inputPath)
+	case info.IsDir():
+		if outputPath == stdioName {
+			exitWithToPNGUsageError("a directory cannot be written to standard output")
+		}
+		if outputPath == "" {
+			outputPath = inputPath
+		}
+		err = c.convertDir(inputPath, outputPath)
+	default:
+		var archive bool
+		if archive, err = isArchive(inputPath); err != nil {
+			break
+		}
+		if archive {
+			if outputPath == stdioName {
+				exitWithToPNGUsageError("a pk3 cannot be written to standard output")
+			}
+			if outputPath == "" {
+				outputPath = strings.TrimSuffix(inputPath, filepath.Ext(inputPath))
+				if outputPath == inputPath {
+					err = fmt.Errorf("cannot derive an output directory from %s; give one explicitly", inputPath)
+					break
+				}
+			}
+			err = c.convertArchive(inputPath, outputPath)
+			break
+		}
+		if outputPath == "" {
+			outputPath = pngPath(inputPath)
+			if outputPath == inputPath {
+				err = fmt.Errorf("cannot derive an output name from %s; give one explicitly", inputPath)
+				break
+			}
+		}
+		c.convertFile(inputPath, outputPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if c.failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+func TestArchivePath(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"textures/base/wall.tga", filepath.Join("textures", "base", "wall.tga"), true},
+		{`textures\base\wall.tga`, filepath.Join("textures", "base", "wall.tga"), true},
+		{"../x.tga", "", false},
+		{"textures/../../x.tga", "", false},
+		{`a\..\..\x.tga`, "", false},
+		{"/abs.tga", "", false},
+		{`\abs.tga`, "", false},
+		{`C:\x.tga`, "", false},
+		{"C:x.tga", "", false},
+	}
+	for _, c := range cases {
+		got, ok := archivePath(c.name)
+		if got != c.want || ok != c.ok {
+			t.Errorf("archivePath(%q) = %q, %v, want %q, %v", c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// writeTestTGA writes a 1x1 TGA of colour c.
+func writeTestTGA(t *testing.T, path string, c color.NRGBA) {
+	t.Helper()
+	m := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	m.SetNRGBA(0, 0, c)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := tga.Encode(f, m, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToPNGDirectoryCollision(t *testing.T) {
+	dir := t.TempDir()
+	// WalkDir goes in lexical order, so a.TGA comes first.
+	writeTestTGA(t, filepath.Join(dir, "a.TGA"), color.NRGBA{R: 255, A: 255})
+	writeTestTGA(t, filepath.Join(dir, "a.tga"), color.NRGBA{G: 255, A: 255})
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Skip("the file system does not tell a.tga from a.TGA")
+	}
+
+	stderr, status := runMain(t, toPNGCommand, "-q", dir)
+	if status == 0 {
+		t.Errorf("exit status 0 although a.tga collided with a.TGA")
+	}
+	if !strings.Contains(stderr, "already written") {
+		t.Errorf("the collision was not reported: %q", stderr)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.NRGBAModel.Convert(m.At(0, 0)); got != (color.NRGBA{R: 255, A: 255}) {
+		t.Errorf("a.png is %v, want the red of a.TGA", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/internal/pixel"
+	"github.com/Vorschreibung/convert-png-to-idtech3-tga/tga"
+)
+
+// verifyTGAFile reads back the TGA written to f, which is to become path,
+// and verifies it with verifyTGA.
+func verifyTGAFile(path string, f *os.File, img image.Image, enc tgaEncoding, hasFooter bool) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("verify: %s: %v", path, err)
+	}
+	return verifyTGA(path, f, info.Size(), img, enc, hasFooter)
+}
+
+// verifyTGA checks the header of the size-byte TGA in r, called name in
+// errors, against enc and every pixel against what img should have been
+// encoded as. Unlike encoding, this holds the decoded output and, for sources
+// that are not NRGBA, a converted copy of img in memory.
+func verifyTGA(name string, r io.ReaderAt, size int64, img image.Image, enc tgaEncoding, hasFooter bool) error {
+	width := img.Bounds().Dx()
+	height := img.Bounds().Dy()
+
+	header, err := tga.ReadHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return fmt.Errorf("verify: %s: %v", name, err)
+	}
+	fields := []struct {
+		name      string
+		got, want int
+	}{
+		{"ID length", int(header.IDLength), 0},
+		{"colour map type", int(header.ColorMapType), 0},
+		{"image type", int(header.ImageType), int(enc.imageType)},
+		{"width", int(header.Width), width},
+		{"height", int(header.Height), height},
+		{"pixel depth", int(header.PixelDepth), enc.depth},
+		{"descriptor", int(header.Descriptor), int(enc.descriptor())},
+	}
+	for _, f := range fields {
+		if f.got != f.want {
+			return fmt.Errorf("verify: %s: header %s is %d, expected %d", name, f.name, f.got, f.want)
+		}
+	}
+
+	if hasFooter {
+		if err := verifyFooter(r, size); err != nil {
+			return fmt.Errorf("verify: %s: %v", name, err)
+		}
+	}
+
+	decoded, err := tga.Decode(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return fmt.Errorf("verify: %s: %v", name, err)
+	}
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = pixel.ToNRGBA(img)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			want := pixel.EncodedColor(nrgba.NRGBAAt(x, y), enc.depth)
+			got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			if got != want {
+				return fmt.Errorf("verify: %s: first mismatch at (%d, %d): decoded %s, expected %s",
+					name, x, y, formatNRGBA(got), formatNRGBA(want))
+			}
+		}
+	}
+	return nil
+}
+
+func formatNRGBA(c color.NRGBA) string {
+	return fmt.Sprintf("rgba(%d, %d, %d, %d)", c.R, c.G, c.B, c.A)
+}
+
+// verifyFooter checks that a TGA 2.0 footer ends the size-byte TGA in r and points at a
+// well-formed extension area.
+func verifyFooter(r io.ReaderAt, size int64) error {
+	if size < tga.HeaderSize+tga.ExtensionAreaSize+tga.FooterSize {
+		return fmt.Errorf("file too short for a TGA 2.0 footer")
+	}
+
+	var footer [tga.FooterSize]byte
+	if _, err := r.ReadAt(footer[:], size-tga.FooterSize); err != nil {
+		return err
+	}
+	if !bytes.Equal(footer[8:], []byte(tga.Signature)) {
+		return fmt.Errorf("missing TGA 2.0 footer signature")
+	}
+	offset := int64(binary.LittleEndian.Uint32(footer[0:]))
+	if want := size - tga.FooterSize - tga.ExtensionAreaSize; offset != want {
+		return fmt.Errorf("footer extension offset is %d, expected %d", offset, want)
+	}
+
+	var extSize [2]byte
+	if _, err := r.ReadAt(extSize[:], offset); err != nil {
+		return err
+	}
+	if got := binary.LittleEndian.Uint16(extSize[:]); got != tga.ExtensionAreaSize {
+		return fmt.Errorf("extension area size is %d, expected %d", got, tga.ExtensionAreaSize)
+	}
+	return nil
+}